@@ -0,0 +1,75 @@
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+* Auth guard the api. With Token every /v1/ request needs an Authorization: Bearer header
+* holding it, with ClientCA the server only accepts clients presenting a certificate signed
+* by it. Cert and Key serve the api over https, they are required by ClientCA. Without
+* Token nor ClientCA writes are refused, the api is read only.
+ */
+type Auth struct {
+	Token    string
+	Cert     string
+	Key      string
+	ClientCA string
+}
+
+func (a Auth) enabled() bool {
+	return a.Token != "" || a.ClientCA != ""
+}
+
+// tlsConfig return the tls config of the server, nil when serving plain http
+func (a Auth) tlsConfig() (*tls.Config, error) {
+	if a.Cert == "" && a.Key == "" && a.ClientCA == "" {
+		return nil, nil
+	}
+	if a.Cert == "" || a.Key == "" {
+		return nil, errors.New("api cert and key are both required for https")
+	}
+	config := &tls.Config{}
+	if a.ClientCA != "" {
+		data, err := ioutil.ReadFile(a.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("invalid api client ca " + a.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// authorized report whether r carries the configured credentials
+func (a Auth) authorized(r *http.Request) bool {
+	if a.ClientCA != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if a.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+	}
+	return a.ClientCA != ""
+}
+
+// sameOrigin reject requests sent by pages of other sites, requests without Origin come from non browser clients
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
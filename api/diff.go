@@ -0,0 +1,99 @@
+package api
+
+import (
+	"strings"
+)
+
+/*
+* maxDiffEdits bound the edit script, the myers trace holds about maxDiffEdits^2 ints.
+* Files with more changed lines are only reported as different.
+ */
+const maxDiffEdits = 1000
+
+/*
+* lineDiff return a line diff from a to b, unchanged lines start with a space,
+* removed lines with - and added lines with +. Empty result means no difference.
+ */
+func lineDiff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+	lines, ok := myers(x, y, maxDiffEdits)
+	if !ok {
+		return "files differ, too many changes to diff\n"
+	}
+	var out strings.Builder
+	for _, line := range lines {
+		out.WriteString(line + "\n")
+	}
+	return out.String()
+}
+
+/*
+* myers return the diff lines of the shortest edit script from a to b, false when it
+* needs more than maxEdits insertions and deletions. trace[d] keeps the furthest x
+* reached on diagonals -d..d after d edits, it is walked back from the end.
+ */
+func myers(a, b []string, maxEdits int) ([]string, bool) {
+	n, m := len(a), len(b)
+	offset := maxEdits + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= maxEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	return nil, false
+}
+
+func backtrack(a, b []string, trace [][]int, edits int) []string {
+	lines := make([]string, 0, len(a)+len(b))
+	x, y := len(a), len(b)
+	for d := edits; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			lines = append(lines, " "+a[x])
+		}
+		if prevK == k+1 {
+			lines = append(lines, "+"+b[prevY])
+		} else {
+			lines = append(lines, "-"+a[prevX])
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 {
+		x--
+		lines = append(lines, " "+a[x])
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
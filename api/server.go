@@ -0,0 +1,337 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/leightonwong/topod/conf/template"
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store"
+)
+
+/*
+* Server is the embedded management api, keys in urls are relative to the configured prefix.
+*	GET    /v1/keys/{key}            value and index of a key, or all values under a directory
+*	PUT    /v1/keys/{key}[?index=N]  set key to the value of a {"value":...} json body, index or
+*	                                 create=true guard the write
+*	DELETE /v1/keys/{key}            delete key, recursive=true delete the whole tree
+*	GET    /v1/prefixes/{prefix}     direct children of a prefix, directories end with /
+*	GET    /v1/resources             loaded template resources and their last render status
+*	GET    /v1/consumers/{key}       template resources reading the key
+*	GET    /v1/render?dest={dest}    current dest content, content rendered now and their diff
+*	GET    /ui/                      web ui on top of the api
+* Requests of /v1/ are checked against Auth, and refused when sent by a page of another origin.
+* Without Auth only resources and consumers are served, keys and rendered content may hold secrets.
+ */
+type Server struct {
+	listen    string
+	prefix    string
+	client    store.StoreClient
+	processor template.Processor
+	auth      Auth
+	mux       *http.ServeMux
+	http      *http.Server
+}
+
+type keyResponse struct {
+	Key    string            `json:"key"`
+	Value  string            `json:"value,omitempty"`
+	Index  uint64            `json:"index,omitempty"`
+	Dir    bool              `json:"dir,omitempty"`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+type renderResponse struct {
+	Dest     string `json:"dest"`
+	Current  string `json:"current"`
+	Rendered string `json:"rendered"`
+	Diff     string `json:"diff"`
+	Error    string `json:"error,omitempty"`
+}
+
+type setRequest struct {
+	Value *string `json:"value"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewServer(listen, prefix string, auth Auth, client store.StoreClient, processor template.Processor) (*Server, error) {
+	tlsConfig, err := auth.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listen:    listen,
+		prefix:    path.Join("/", prefix),
+		client:    client,
+		processor: processor,
+		auth:      auth,
+		mux:       http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/keys/", s.handleKeys)
+	s.mux.HandleFunc("/v1/prefixes/", s.handlePrefixes)
+	s.mux.HandleFunc("/v1/resources", s.handleResources)
+	s.mux.HandleFunc("/v1/consumers/", s.handleConsumers)
+	s.mux.HandleFunc("/v1/render", s.handleRender)
+	s.mux.HandleFunc("/ui/", handleUI)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeJson(w, http.StatusNotFound, errorResponse{"not found"})
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	s.http = &http.Server{Addr: listen, Handler: s, TLSConfig: tlsConfig}
+	if !auth.enabled() {
+		logger.Log.Warning("Management api has no token nor client_ca, it only serves resources and consumers")
+	}
+	return s, nil
+}
+
+// ListenAndServe serve the api until Shutdown, then it returns http.ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	logger.Log.Notice("Management api listening on %s", s.listen)
+	if s.http.TLSConfig != nil {
+		return s.http.ListenAndServeTLS(s.auth.Cert, s.auth.Key)
+	}
+	return s.http.ListenAndServe()
+}
+
+// Shutdown stop accepting connections and wait for requests in progress until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Log.Debug("Api request %s %s", r.Method, r.URL.String())
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		if !sameOrigin(r) {
+			writeJson(w, http.StatusForbidden, errorResponse{"cross origin request refused"})
+			return
+		}
+		if s.auth.enabled() && !s.auth.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJson(w, http.StatusUnauthorized, errorResponse{"unauthorized"})
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// requireAuth refuse the request when the api has no token nor client_ca, credentials are checked by ServeHTTP
+func (s *Server) requireAuth(w http.ResponseWriter) bool {
+	if !s.auth.enabled() {
+		writeJson(w, http.StatusForbidden, errorResponse{"set an api token or client_ca to access keys and rendered content"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) fullKey(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *Server) relativeKey(key string) string {
+	return path.Join("/", strings.TrimPrefix(key, s.prefix))
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAuth(w) {
+		return
+	}
+	key := path.Join("/", strings.TrimPrefix(r.URL.Path, "/v1/keys"))
+	switch r.Method {
+	case "GET":
+		s.getKey(w, key)
+	case "PUT":
+		s.setKey(w, r, key)
+	case "DELETE":
+		var err error
+		if r.URL.Query().Get("recursive") == "true" {
+			err = s.client.DeleteTree(s.fullKey(key))
+		} else {
+			err = s.client.Delete(s.fullKey(key))
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, keyResponse{Key: key})
+	default:
+		writeJson(w, http.StatusMethodNotAllowed, errorResponse{"method not allowed"})
+	}
+}
+
+func (s *Server) getKey(w http.ResponseWriter, key string) {
+	value, index, err := s.client.Get(s.fullKey(key))
+	if err == nil {
+		writeJson(w, http.StatusOK, keyResponse{Key: key, Value: value, Index: index})
+		return
+	}
+	if err != store.ErrKeyNotFound {
+		writeError(w, err)
+		return
+	}
+	values, err := s.client.GetValues([]string{s.fullKey(key)})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(values) == 0 {
+		writeError(w, store.ErrKeyNotFound)
+		return
+	}
+	resp := keyResponse{Key: key, Dir: true, Values: make(map[string]string)}
+	for k, v := range values {
+		resp.Values[s.relativeKey(k)] = v
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+// setKey take the value from a json body, html forms can not send one without a cors preflight
+func (s *Server) setKey(w http.ResponseWriter, r *http.Request, key string) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJson(w, http.StatusUnsupportedMediaType, errorResponse{"content type must be application/json"})
+		return
+	}
+	var req setRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == nil {
+		writeJson(w, http.StatusBadRequest, errorResponse{`body must be {"value":"..."}`})
+		return
+	}
+	value := *req.Value
+	var err error
+	var index uint64
+	query := r.URL.Query()
+	if v := query.Get("index"); v != "" {
+		if index, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeJson(w, http.StatusBadRequest, errorResponse{"bad index " + v})
+			return
+		}
+	}
+	if index > 0 || query.Get("create") == "true" {
+		index, err = s.client.CompareAndSwap(s.fullKey(key), value, index)
+	} else {
+		index, err = s.client.Set(s.fullKey(key), value)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, keyResponse{Key: key, Value: value, Index: index})
+}
+
+func (s *Server) handlePrefixes(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAuth(w) {
+		return
+	}
+	prefix := path.Join("/", strings.TrimPrefix(r.URL.Path, "/v1/prefixes"))
+	values, err := s.client.GetValues([]string{s.fullKey(prefix)})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	children := make(map[string]bool)
+	for k := range values {
+		rest := strings.TrimPrefix(strings.TrimPrefix(s.relativeKey(k), prefix), "/")
+		if rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			children[rest[:i+1]] = true
+		} else {
+			children[rest] = true
+		}
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJson(w, http.StatusOK, names)
+}
+
+func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]template.ResourceStatus, 0)
+	for _, t := range s.resources() {
+		statuses = append(statuses, t.Status())
+	}
+	writeJson(w, http.StatusOK, statuses)
+}
+
+func (s *Server) resources() []*template.TemplateResource {
+	if s.processor == nil {
+		return nil
+	}
+	return s.processor.Resources()
+}
+
+func (s *Server) handleConsumers(w http.ResponseWriter, r *http.Request) {
+	key := s.fullKey(strings.TrimPrefix(r.URL.Path, "/v1/consumers"))
+	statuses := make([]template.ResourceStatus, 0)
+	for _, t := range s.resources() {
+		if t.Consumes(key) {
+			statuses = append(statuses, t.Status())
+		}
+	}
+	writeJson(w, http.StatusOK, statuses)
+}
+
+// handleRender compare dest content with what the resource would render now, nothing is written.
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAuth(w) {
+		return
+	}
+	dest := r.URL.Query().Get("dest")
+	for _, t := range s.resources() {
+		if t.Dest != dest {
+			continue
+		}
+		resp := renderResponse{Dest: dest}
+		if current, err := ioutil.ReadFile(dest); err == nil {
+			resp.Current = string(current)
+		} else {
+			resp.Error = err.Error()
+		}
+		rendered, err := t.Preview()
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Rendered = string(rendered)
+			resp.Diff = lineDiff(resp.Current, resp.Rendered)
+		}
+		writeJson(w, http.StatusOK, resp)
+		return
+	}
+	writeJson(w, http.StatusNotFound, errorResponse{"no template resource for dest " + dest})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case store.ErrKeyNotFound:
+		code = http.StatusNotFound
+	case store.ErrCompareFailed:
+		code = http.StatusConflict
+	case store.ErrNotSupported:
+		code = http.StatusNotImplemented
+	}
+	writeJson(w, code, errorResponse{err.Error()})
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Log.Error("Write api response error: %s", err.Error())
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+const testToken = "s3cret"
+
+func request(t *testing.T, s *Server, method, url, body string, expectCode int, result interface{}) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != expectCode {
+		t.Fatalf("%s %s code = %d, expect %d, body %s", method, url, w.Code, expectCode, w.Body.String())
+	}
+	if result != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	st := storetest.NewClient(map[string]string{
+		"/app/db/host": "10.0.0.1",
+		"/app/db/port": "3306",
+		"/app/name":    "app",
+	})
+	s, err := NewServer("", "/app", Auth{Token: testToken}, st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var key keyResponse
+	request(t, s, "GET", "/v1/keys/db/host", "", http.StatusOK, &key)
+	if key.Value != "10.0.0.1" || key.Index == 0 {
+		t.Errorf("get key = %+v", key)
+	}
+	var dir keyResponse
+	request(t, s, "GET", "/v1/keys/db", "", http.StatusOK, &dir)
+	if !dir.Dir || !reflect.DeepEqual(dir.Values, map[string]string{"/db/host": "10.0.0.1", "/db/port": "3306"}) {
+		t.Errorf("get dir = %+v", dir)
+	}
+	request(t, s, "GET", "/v1/keys/missing", "", http.StatusNotFound, nil)
+
+	request(t, s, "PUT", "/v1/keys/db/host?index=999", `{"value":"10.0.0.2"}`, http.StatusConflict, nil)
+	var set keyResponse
+	request(t, s, "PUT", "/v1/keys/db/host?index="+strconv.FormatUint(key.Index, 10), `{"value":"10.0.0.2"}`, http.StatusOK, &set)
+	if allValues(st)["/app/db/host"] != "10.0.0.2" {
+		t.Errorf("put with index did not write, store %v", allValues(st))
+	}
+
+	var prefixes []string
+	request(t, s, "GET", "/v1/prefixes/", "", http.StatusOK, &prefixes)
+	if !reflect.DeepEqual(prefixes, []string{"db/", "name"}) {
+		t.Errorf("prefixes = %v", prefixes)
+	}
+
+	request(t, s, "DELETE", "/v1/keys/db?recursive=true", "", http.StatusOK, nil)
+	if len(allValues(st)) != 1 {
+		t.Errorf("delete recursive left %v", allValues(st))
+	}
+}
+
+func TestResources(t *testing.T) {
+	s, _ := NewServer("", "/", Auth{Token: testToken}, storetest.NewClient(nil), nil)
+	var statuses []interface{}
+	request(t, s, "GET", "/v1/resources", "", http.StatusOK, &statuses)
+	if len(statuses) != 0 {
+		t.Errorf("resources without processor = %v", statuses)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	st := storetest.NewClient(map[string]string{"/app/name": "app"})
+	s, _ := NewServer("", "/", Auth{Token: testToken}, st, nil)
+	send := func(method, url, body string, header map[string]string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+	auth := "Bearer " + testToken
+	json := "application/json"
+	for _, c := range []struct {
+		method, body string
+		header       map[string]string
+		expect       int
+	}{
+		{"GET", "", nil, http.StatusUnauthorized},
+		{"GET", "", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"GET", "", map[string]string{"Authorization": auth}, http.StatusOK},
+		//cross site form post
+		{"POST", "x", map[string]string{"Authorization": auth, "Content-Type": "text/plain"}, http.StatusMethodNotAllowed},
+		{"PUT", "x", map[string]string{"Authorization": auth, "Content-Type": "text/plain"}, http.StatusUnsupportedMediaType},
+		{"PUT", `{"value":"x"}`, map[string]string{"Authorization": auth, "Content-Type": json, "Origin": "http://evil.example"}, http.StatusForbidden},
+		{"PUT", `{"value":"x"}`, map[string]string{"Authorization": auth, "Content-Type": json, "Origin": "http://example.com"}, http.StatusOK},
+	} {
+		if code := send(c.method, "/v1/keys/app/name", c.body, c.header); code != c.expect {
+			t.Errorf("%s %v code = %d, expect %d", c.method, c.header, code, c.expect)
+		}
+	}
+	if v := allValues(st)["/app/name"]; v != "x" {
+		t.Errorf("value = %q after authorized put, expect x", v)
+	}
+
+	//without auth only resources and consumers are served
+	s, _ = NewServer("", "/", Auth{}, st, nil)
+	for _, c := range []struct {
+		method, url, body string
+		code              int
+	}{
+		{"GET", "/v1/keys/app/name", "", http.StatusForbidden},
+		{"PUT", "/v1/keys/app/name", `{"value":"y"}`, http.StatusForbidden},
+		{"DELETE", "/v1/keys/app/name", "", http.StatusForbidden},
+		{"GET", "/v1/prefixes/app", "", http.StatusForbidden},
+		{"GET", "/v1/render?dest=/etc/app.conf", "", http.StatusForbidden},
+		{"GET", "/v1/resources", "", http.StatusOK},
+		{"GET", "/v1/consumers/app/name", "", http.StatusOK},
+	} {
+		if code := send(c.method, c.url, c.body, map[string]string{"Content-Type": json}); code != c.code {
+			t.Errorf("%s %s without auth code = %d, expect %d", c.method, c.url, code, c.code)
+		}
+	}
+}
+
+func allValues(c *storetest.Client) map[string]string {
+	values, _ := c.GetValues([]string{"/"})
+	return values
+}
+
+func TestLineDiff(t *testing.T) {
+	if d := lineDiff("a\nb\n", "a\nb\n"); d != "" {
+		t.Errorf("diff of same content = %q, expect empty", d)
+	}
+	for _, c := range []struct{ a, b, expect string }{
+		{"a\nb\n", "a\nc\n", " a\n-b\n+c\n \n"},
+		{"", "a", "-\n+a\n"},
+		{"a\nb\nc", "b\nc\nd", "-a\n b\n c\n+d\n"},
+		{"a\nb\nc\nd", "a\nx\nc\ny", " a\n-b\n+x\n c\n-d\n+y\n"},
+	} {
+		if d := lineDiff(c.a, c.b); d != c.expect {
+			t.Errorf("lineDiff(%q, %q) = %q, expect %q", c.a, c.b, d, c.expect)
+		}
+	}
+	//large files with few changes are diffed, many changes are only reported
+	var a, b []string
+	for i := 0; i < 50000; i++ {
+		a = append(a, strconv.Itoa(i))
+		b = append(b, strconv.Itoa(i))
+	}
+	b[25000] = "changed"
+	if d := lineDiff(strings.Join(a, "\n"), strings.Join(b, "\n")); !strings.Contains(d, "-25000\n+changed\n") {
+		t.Errorf("diff of one changed line in a large file missing the change")
+	}
+	for i := range b {
+		b[i] = "x" + b[i]
+	}
+	if d := lineDiff(strings.Join(a, "\n"), strings.Join(b, "\n")); d != "files differ, too many changes to diff\n" {
+		t.Errorf("diff of too many changes = %.40q...", d)
+	}
+}
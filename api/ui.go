@@ -0,0 +1,162 @@
+package api
+
+import (
+	"net/http"
+)
+
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(indexHTML))
+}
+
+// indexHTML is the whole web ui, a single page using the management api
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>topod</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#keys { width: 35%; overflow: auto; border-right: 1px solid #ccc; padding: 8px; }
+#main { flex: 1; overflow: auto; padding: 8px; }
+ul { list-style: none; padding-left: 16px; margin: 0; }
+.dir { cursor: pointer; font-weight: bold; }
+.key { cursor: pointer; }
+.key:hover, .dir:hover, tr.res:hover { background: #eef; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border: 1px solid #ddd; padding: 4px; text-align: left; font-size: 13px; }
+tr.res { cursor: pointer; }
+.error { color: #b00; }
+pre { background: #f7f7f7; padding: 6px; overflow: auto; font-size: 12px; }
+.add { color: #080; }
+.del { color: #b00; }
+</style>
+</head>
+<body>
+<div id="keys"><h3>Keys</h3><div id="tree"></div></div>
+<div id="main">
+<h3>Template resources</h3>
+<table id="resources"></table>
+<div id="detail"></div>
+</div>
+<script>
+function get(url) {
+  var headers = {};
+  var token = sessionStorage.getItem("topod-token");
+  if (token) headers["Authorization"] = "Bearer " + token;
+  return fetch(url, { headers: headers }).then(function (r) {
+    if (r.status == 401) {
+      token = prompt("Api token");
+      if (token) {
+        sessionStorage.setItem("topod-token", token);
+        return get(url);
+      }
+    }
+    return r.json();
+  });
+}
+function esc(s) {
+  var d = document.createElement("div");
+  d.textContent = s;
+  return d.innerHTML;
+}
+function buildTree(values) {
+  var root = {};
+  Object.keys(values).sort().forEach(function (k) {
+    var node = root;
+    var parts = k.split("/").filter(function (p) { return p; });
+    parts.forEach(function (p, i) {
+      if (i == parts.length - 1) {
+        node[p] = node[p] || {};
+        node[p][""] = { key: k, value: values[k] };
+      } else {
+        node = node[p] = node[p] || {};
+      }
+    });
+  });
+  return root;
+}
+function renderTree(node) {
+  var ul = document.createElement("ul");
+  Object.keys(node).sort().forEach(function (name) {
+    if (!name) return;
+    var li = document.createElement("li");
+    var child = node[name];
+    var leaf = child[""];
+    var span = document.createElement("span");
+    if (Object.keys(child).length > 1 || !leaf) {
+      span.className = "dir";
+      span.textContent = name + "/";
+      var sub = renderTree(child);
+      span.onclick = function () { sub.hidden = !sub.hidden; };
+      li.appendChild(span);
+      li.appendChild(sub);
+    } else {
+      span.className = "key";
+      span.textContent = name + " = " + leaf.value;
+      li.appendChild(span);
+    }
+    if (leaf) {
+      span.onclick = function () { showKey(leaf.key, leaf.value); };
+    }
+    ul.appendChild(li);
+  });
+  return ul;
+}
+function loadKeys() {
+  get("/v1/keys/").then(function (r) {
+    var values = r.values || {};
+    if (!r.dir && r.key) values[r.key] = r.value;
+    var tree = document.getElementById("tree");
+    tree.innerHTML = "";
+    tree.appendChild(renderTree(buildTree(values)));
+  });
+}
+function showKey(key, value) {
+  get("/v1/consumers" + key).then(function (list) {
+    var html = "<h3>Key " + esc(key) + "</h3><pre>" + esc(value) + "</pre><h4>Consumed by</h4>";
+    if (!list.length) html += "<p>no template resource reads this key</p>";
+    html += "<ul>" + list.map(function (t) {
+      return "<li>" + esc(t.src) + " &rarr; " + esc(t.dest) + "</li>";
+    }).join("") + "</ul>";
+    document.getElementById("detail").innerHTML = html;
+  });
+}
+function showRender(dest) {
+  get("/v1/render?dest=" + encodeURIComponent(dest)).then(function (r) {
+    var html = "<h3>" + esc(dest) + "</h3>";
+    if (r.error) html += "<p class=error>" + esc(r.error) + "</p>";
+    html += "<h4>Diff against rendering now</h4>";
+    if (!r.diff) {
+      html += "<p>no change</p>";
+    } else {
+      html += "<pre>" + r.diff.split("\n").map(function (l) {
+        var c = l[0] == "+" ? "add" : l[0] == "-" ? "del" : "";
+        return "<span class=\"" + c + "\">" + esc(l) + "</span>";
+      }).join("\n") + "</pre>";
+    }
+    html += "<h4>Current content</h4><pre>" + esc(r.current) + "</pre>";
+    document.getElementById("detail").innerHTML = html;
+  });
+}
+function loadResources() {
+  get("/v1/resources").then(function (list) {
+    var table = document.getElementById("resources");
+    table.innerHTML = "<tr><th>src</th><th>dest</th><th>prefix</th><th>keys</th><th>last render</th><th>error</th></tr>";
+    list.forEach(function (t) {
+      var tr = document.createElement("tr");
+      tr.className = "res";
+      tr.innerHTML = "<td>" + esc(t.src) + "</td><td>" + esc(t.dest) + "</td><td>" + esc(t.prefix) +
+        "</td><td>" + esc((t.keys || []).join(", ")) + "</td><td>" + esc(t.last_render) +
+        "</td><td class=error>" + esc(t.last_error) + "</td>";
+      tr.onclick = function () { showRender(t.dest); };
+      table.appendChild(tr);
+    });
+  });
+}
+loadKeys();
+loadResources();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	storage "github.com/leightonwong/topod/store"
+)
+
+/*
+* Central configuration view and edit verbs: get, set, rm, ls, export and import,
+* and register which publishes a service until interrupted.
+* Keys on the command line are relative to the configured prefix.
+ */
+func runCommand(client storage.StoreClient) error {
+	switch options.Verbs {
+	case "get":
+		return runGet(client, options.Get.Remainder, options.Get.Json, os.Stdout)
+	case "set":
+		return runSet(client, options.Set.Remainder, options.Set.Index, options.Set.Create, os.Stdout)
+	case "rm":
+		return runRm(client, options.Rm.Remainder, options.Rm.Recursive)
+	case "ls":
+		return runLs(client, options.Ls.Remainder, options.Ls.Json, os.Stdout)
+	case "export":
+		return runExport(client, options.Export.Format, os.Stdout)
+	case "import":
+		return runImport(client, options.Import.Remainder, options.Import.DryRun, options.Import.Delete, os.Stdout)
+	case "register":
+		return runRegister(client)
+	}
+	return errors.New("Unknown command " + string(options.Verbs))
+}
+
+func fullKey(key string) string {
+	return path.Join("/", config.Prefix, key)
+}
+
+func relativeKey(key string) string {
+	return path.Join("/", strings.TrimPrefix(key, path.Join("/", config.Prefix)))
+}
+
+// runGet print value of every key, keys pointing to a directory print the whole sub tree
+func runGet(client storage.StoreClient, keys []string, asJson bool, w io.Writer) error {
+	if len(keys) == 0 {
+		return errors.New("get: key required")
+	}
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = fullKey(key)
+	}
+	values, err := client.GetValues(full)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("get: %s not found", strings.Join(keys, ", "))
+	}
+	if asJson {
+		return printJson(values, w)
+	}
+	if len(keys) == 1 {
+		if v, ok := values[full[0]]; ok && len(values) == 1 {
+			fmt.Fprintln(w, v)
+			return nil
+		}
+	}
+	printTree(values, w)
+	return nil
+}
+
+// runSet set key to value, with index or create flag the write is guarded by CompareAndSwap
+func runSet(client storage.StoreClient, args []string, index uint64, create bool, w io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("set: key and value required")
+	}
+	key := fullKey(args[0])
+	var modified uint64
+	var err error
+	if index > 0 || create {
+		modified, err = client.CompareAndSwap(key, args[1], index)
+	} else {
+		modified, err = client.Set(key, args[1])
+	}
+	if err != nil {
+		return fmt.Errorf("set %s: %s", key, err.Error())
+	}
+	fmt.Fprintf(w, "%s index %d\n", key, modified)
+	return nil
+}
+
+func runRm(client storage.StoreClient, keys []string, recursive bool) error {
+	if len(keys) == 0 {
+		return errors.New("rm: key required")
+	}
+	for _, key := range keys {
+		key = fullKey(key)
+		var err error
+		if recursive {
+			err = client.DeleteTree(key)
+		} else {
+			err = client.Delete(key)
+		}
+		if err != nil {
+			return fmt.Errorf("rm %s: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// runLs print key tree under the given keys, or the whole prefix without keys
+func runLs(client storage.StoreClient, keys []string, asJson bool, w io.Writer) error {
+	if len(keys) == 0 {
+		keys = []string{"/"}
+	}
+	full := make([]string, len(keys))
+	for i, key := range keys {
+		full[i] = fullKey(key)
+	}
+	values, err := client.GetValues(full)
+	if err != nil {
+		return err
+	}
+	if asJson {
+		return printJson(values, w)
+	}
+	printTree(values, w)
+	return nil
+}
+
+// keyTree is a nested view of flat store keys, leaf values are strings
+type keyTree map[string]interface{}
+
+func newKeyTree(values map[string]string) keyTree {
+	tree := make(keyTree)
+	for k, v := range values {
+		node := tree
+		parts := strings.Split(strings.Trim(relativeKey(k), "/"), "/")
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				//a key with a value and children keeps children, value goes to ""
+				if child, ok := node[part].(keyTree); ok {
+					child[""] = v
+				} else {
+					node[part] = v
+				}
+				break
+			}
+			child, ok := node[part].(keyTree)
+			if !ok {
+				child = make(keyTree)
+				if leaf, isLeaf := node[part].(string); isLeaf {
+					child[""] = leaf
+				}
+				node[part] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+func printJson(values map[string]string, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(newKeyTree(values))
+}
+
+func printTree(values map[string]string, w io.Writer) {
+	printNode(newKeyTree(values), 0, w)
+}
+
+func printNode(tree keyTree, depth int, w io.Writer) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	indent := strings.Repeat("  ", depth)
+	for _, name := range names {
+		switch n := tree[name].(type) {
+		case string:
+			if name != "" {
+				fmt.Fprintf(w, "%s%s = %s\n", indent, name, n)
+			}
+		case keyTree:
+			if v, ok := n[""].(string); ok {
+				fmt.Fprintf(w, "%s%s/ = %s\n", indent, name, v)
+			} else {
+				fmt.Fprintf(w, "%s%s/\n", indent, name)
+			}
+			printNode(n, depth+1, w)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+func TestCommands(t *testing.T) {
+	defer func(prefix string) { config.Prefix = prefix }(config.Prefix)
+	config.Prefix = "/app"
+	store := storetest.NewClient(map[string]string{
+		"/app/db/host": "10.0.0.1",
+		"/app/db/port": "3306",
+		"/app/name":    "app",
+		"/other/key":   "x",
+	})
+	var out bytes.Buffer
+	if err := runGet(store, []string{"db/host"}, false, &out); err != nil || out.String() != "10.0.0.1\n" {
+		t.Errorf("get db/host = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := runLs(store, nil, false, &out); err != nil {
+		t.Fatal(err)
+	}
+	expect := "db/\n  host = 10.0.0.1\n  port = 3306\nname = app\n"
+	if out.String() != expect {
+		t.Errorf("ls = %q, expect %q", out.String(), expect)
+	}
+	out.Reset()
+	if err := runGet(store, []string{"db"}, true, &out); err != nil || !strings.Contains(out.String(), `"port": "3306"`) {
+		t.Errorf("get -j db = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := runSet(store, []string{"name", "new"}, 999, false, &out); err == nil {
+		t.Errorf("set with stale index expect error")
+	}
+	_, index, _ := store.Get("/app/name")
+	if err := runSet(store, []string{"name", "new"}, index, false, &out); err != nil || allValues(store)["/app/name"] != "new" {
+		t.Errorf("set with current index = %v", err)
+	}
+	if err := runRm(store, []string{"db"}, true); err != nil || len(allValues(store)) != 2 {
+		t.Errorf("rm -r db = %v, left %v", err, allValues(store))
+	}
+}
+
+func TestImport(t *testing.T) {
+	defer func(prefix string) { config.Prefix = prefix }(config.Prefix)
+	config.Prefix = "/staging"
+	dir, err := ioutil.TempDir("", "topod-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "app.json")
+	ioutil.WriteFile(f, []byte(`{"db": {"host": "10.0.0.2", "port": "3306"}}`), 0644)
+	store := storetest.NewClient(map[string]string{
+		"/staging/db/host": "10.0.0.1",
+		"/staging/old":     "x",
+	})
+	var out bytes.Buffer
+	if err := runImport(store, []string{f}, true, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	expect := "~ /staging/db/host: \"10.0.0.1\" -> \"10.0.0.2\"\n+ /staging/db/port = \"3306\"\n- /staging/old\n"
+	if !strings.HasPrefix(out.String(), expect) {
+		t.Errorf("import dry run = %q, expect %q", out.String(), expect)
+	}
+	if allValues(store)["/staging/db/host"] != "10.0.0.1" {
+		t.Errorf("import dry run modified store")
+	}
+	if err := runImport(store, []string{f}, false, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(allValues(store)) != 2 || allValues(store)["/staging/db/host"] != "10.0.0.2" {
+		t.Errorf("import result = %v", allValues(store))
+	}
+}
+
+func allValues(c *storetest.Client) map[string]string {
+	values, _ := c.GetValues([]string{"/"})
+	return values
+}
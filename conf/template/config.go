@@ -2,6 +2,7 @@ package template
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,9 +10,12 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 
@@ -29,6 +33,8 @@ type Config struct {
 	Noop         bool
 	StoreClient  store.StoreClient
 	KeepTempFile bool
+	//check_cmd and reload_cmd are killed after it, no limit when 0
+	CommandTimeout time.Duration
 }
 
 //Template file parsed config, part of vars from template global config above, some from xxx_xxx.toml config file
@@ -38,6 +44,7 @@ type TemplateResource struct {
 	FileMode     os.FileMode
 	Gid          int
 	Keys         []string `toml:"keys"`
+	RequiredKeys []string `toml:"required_keys"`
 	Mode         string   `toml:"mode"`
 	Prefix       string   `toml:"prefix"`
 	ReloadCmd    string   `toml:"reload_cmd"`
@@ -48,10 +55,13 @@ type TemplateResource struct {
 	Uid          int
 	funcMap      map[string]interface{}
 	cache        *memkv.MemStore
-	lastIndex    uint64
+	rendered     map[string]string
 	noop         bool
 	storeClient  store.StoreClient
 	keepTempFile bool
+	cmdTimeout   time.Duration
+	status       ResourceStatus
+	statusLock   sync.RWMutex
 }
 
 var EmptySrcErr = errors.New("empty src template")
@@ -76,9 +86,11 @@ func NewConfigTemplate(path string, config *Config) (*TemplateResource, error) {
 	tr.storeClient = config.StoreClient
 	tr.noop = config.Noop
 	tr.keepTempFile = config.KeepTempFile
+	tr.cmdTimeout = config.CommandTimeout
 	tr.funcMap = newFuncMap()
 	tr.cache = memkv.NewMemStore()
 	addFuncs(tr.funcMap, tr.cache.FuncMap)
+	addFuncs(tr.funcMap, serviceFuncs(tr.cache))
 	tr.Prefix = filepath.Join("/", config.Prefix, tr.Prefix)
 	if tr.Backup && tr.BackupDir == "" {
 		tr.BackupDir = filepath.Dir(tr.Dest)
@@ -93,12 +105,7 @@ func NewConfigTemplate(path string, config *Config) (*TemplateResource, error) {
 func getTemplateResource(config *Config) ([]*TemplateResource, error) {
 	var lastError error
 	templates := make([]*TemplateResource, 0)
-	logger.Log.Debug("Loading template resources from conf dir %s", config.ConfDir)
-	if !isFileExist(config.ConfDir) {
-		logger.Log.Warning("Conf dir %s does not exist", config.ConfDir)
-		return nil, errors.New("Conf dir does not exist")
-	}
-	paths, err := filepath.Glob(filepath.Join(config.ConfDir, "*.toml"))
+	paths, err := resourcePaths(config)
 	if err != nil {
 		return nil, err
 	}
@@ -113,25 +120,51 @@ func getTemplateResource(config *Config) ([]*TemplateResource, error) {
 	return templates, lastError
 }
 
-func (t *TemplateResource) setVars() error {
-	var err error
-	logger.Log.Debug("Retrieving keys from store, key prefix:%s", t.Prefix)
-	result, err := t.storeClient.GetValues(appendPrefixKeys(t.Prefix, t.Keys))
-	if err != nil {
-		return err
+// resourcePaths return the toml files of conf dir
+func resourcePaths(config *Config) ([]string, error) {
+	logger.Log.Debug("Loading template resources from conf dir %s", config.ConfDir)
+	if !isFileExist(config.ConfDir) {
+		logger.Log.Warning("Conf dir %s does not exist", config.ConfDir)
+		return nil, errors.New("Conf dir does not exist")
 	}
+	return filepath.Glob(filepath.Join(config.ConfDir, "*.toml"))
+}
+
+func (t *TemplateResource) fetchValues() (map[string]string, error) {
+	logger.Log.Debug("Retrieving keys from store, key prefix:%s", t.Prefix)
+	return t.storeClient.GetValues(appendPrefixKeys(t.Prefix, t.Keys))
+}
+
+func (t *TemplateResource) setVars(values map[string]string) error {
 	t.cache.Clear()
-	for k, v := range result {
-		t.cache.Set(filepath.Join("/", strings.TrimPrefix(k, t.Prefix)), v)
+	t.fillCache(t.cache, values)
+	//abort rendering instead of writing a config with blank values
+	for _, key := range t.RequiredKeys {
+		key = filepath.Join("/", key)
+		if !t.cache.Exists(key) && len(t.cache.List(key+"/")) == 0 {
+			return errors.New("Missing required key " + filepath.Join(t.Prefix, key))
+		}
 	}
 	return nil
 }
 
+// fillCache store fetched values in cache with keys relative to the resource prefix
+func (t *TemplateResource) fillCache(cache *memkv.MemStore, values map[string]string) {
+	for k, v := range values {
+		cache.Set(filepath.Join("/", strings.TrimPrefix(k, t.Prefix)), v)
+	}
+}
+
 func (t *TemplateResource) createTempFile() error {
 	logger.Log.Debug("Loading source template %s", t.Src)
 	if !isFileExist(t.Src) {
 		return errors.New("Missing template " + t.Src)
 	}
+	logger.Log.Debug("Compiling source template %s", t.Src)
+	tmpl, err := template.New(path.Base(t.Src)).Funcs(t.funcMap).ParseFiles(t.Src)
+	if err != nil {
+		return err
+	}
 	//create template config file in dest dir
 	temp, err := ioutil.TempFile(filepath.Dir(t.Dest), "."+filepath.Base(t.Dest))
 	if err != nil {
@@ -139,9 +172,8 @@ func (t *TemplateResource) createTempFile() error {
 		return err
 	}
 	defer temp.Close()
-	logger.Log.Debug("Compiling source template %s", t.Src)
-	tmpl := template.Must(template.New(path.Base(t.Src)).Funcs(t.funcMap).ParseFiles(t.Src))
 	if err = tmpl.Execute(temp, nil); err != nil {
+		os.Remove(temp.Name())
 		return err
 	}
 	//set owner group mode to the temp file
@@ -191,8 +223,7 @@ func (t *TemplateResource) check() error {
 		return err
 	}
 	logger.Log.Debug("Running " + cmdBuffer.String())
-	c := exec.Command("/bin/sh", "-c", cmdBuffer.String())
-	output, err := c.CombinedOutput()
+	output, err := t.runCmd(cmdBuffer.String())
 	if err != nil {
 		return err
 	}
@@ -204,8 +235,7 @@ func (t *TemplateResource) check() error {
 // It returns nil if the reload command returns 0.
 func (t *TemplateResource) reload() error {
 	logger.Log.Debug("Running " + t.ReloadCmd)
-	c := exec.Command("/bin/sh", "-c", t.ReloadCmd)
-	output, err := c.CombinedOutput()
+	output, err := t.runCmd(t.ReloadCmd)
 	if err != nil {
 		return err
 	}
@@ -213,6 +243,25 @@ func (t *TemplateResource) reload() error {
 	return nil
 }
 
+// runCmd run a shell command, killed when it outlasts the command timeout, so a hung
+// reload can not block the watch of the resource nor the shutdown of topod
+func (t *TemplateResource) runCmd(cmd string) ([]byte, error) {
+	ctx := context.Background()
+	if t.cmdTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.cmdTimeout)
+		defer cancel()
+	}
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	//do not wait for children of the shell still holding the output after a kill
+	c.WaitDelay = time.Second
+	output, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("%s timed out after %s", cmd, t.cmdTimeout)
+	}
+	return output, err
+}
+
 func (t *TemplateResource) sync() error {
 	temp := t.TempFile.Name()
 	if t.keepTempFile {
@@ -273,6 +322,9 @@ func (t *TemplateResource) sync() error {
 				return err
 			}
 		}
+		t.statusLock.Lock()
+		t.status.LastUpdate = time.Now()
+		t.statusLock.Unlock()
 		logger.Log.Info("Target config %s is updated", t.Dest)
 	} else {
 		logger.Log.Warning("Target config %s in sync", t.Dest)
@@ -281,10 +333,51 @@ func (t *TemplateResource) sync() error {
 }
 
 func (t *TemplateResource) process() error {
+	values, err := t.fetchValues()
+	if err == nil {
+		err = t.render(values)
+	}
+	t.recordStatus(err)
+	return err
+}
+
+/*
+* processChange render t after a change of keys under its prefix, keys are nil when the
+* store does not tell them. The render is skipped when t consumes none of keys, or when
+* the values fetched are the ones of the last successful render. It reports whether t was
+* rendered or failed to, false when the render is skipped.
+ */
+func (t *TemplateResource) processChange(keys []string) (bool, error) {
+	if keys != nil && !t.consumesAny(keys) {
+		logger.Log.Debug("Changed keys %v not consumed by %s, skip render", keys, t.Dest)
+		return false, nil
+	}
+	values, err := t.fetchValues()
+	if err == nil {
+		if t.rendered != nil && reflect.DeepEqual(values, t.rendered) {
+			logger.Log.Debug("Values of %s unchanged since last render, skip render", t.Dest)
+			return false, nil
+		}
+		err = t.render(values)
+	}
+	t.recordStatus(err)
+	return true, err
+}
+
+func (t *TemplateResource) consumesAny(keys []string) bool {
+	for _, key := range keys {
+		if t.Consumes(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TemplateResource) render(values map[string]string) error {
 	if err := t.setFileMode(); err != nil {
 		return err
 	}
-	if err := t.setVars(); err != nil {
+	if err := t.setVars(values); err != nil {
 		return err
 	}
 	if err := t.createTempFile(); err != nil {
@@ -293,5 +386,6 @@ func (t *TemplateResource) process() error {
 	if err := t.sync(); err != nil {
 		return err
 	}
+	t.rendered = values
 	return nil
 }
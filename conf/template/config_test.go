@@ -0,0 +1,88 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+func TestProcessTemplateError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	bad := writeResource(t, dir, "bad", "/app", `port {{getv "/port"`)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: storetest.NewClient(map[string]string{"/app/port": "80"}),
+	}
+	if err := ProcessOnce(config); err == nil || !strings.Contains(err.Error(), "bad.tmpl") {
+		t.Errorf("ProcessOnce error = %v, expect the parse error of bad.tmpl", err)
+	}
+	if readFile(app) != "port 80" {
+		t.Errorf("app = %q, expect rendered despite the bad template", readFile(app))
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Errorf("bad dest written, err %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*")); len(files) != 0 {
+		t.Errorf("temp files left %v", files)
+	}
+}
+
+func TestRequiredKeys(t *testing.T) {
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/app/db/host": "10.0.0.1"})
+	for _, c := range []struct {
+		name     string
+		required string
+		err      string
+	}{
+		{"present leaf", `"/port"`, ""},
+		{"missing leaf", `"/port", "/host"`, "Missing required key /app/host"},
+		{"directory with children", `"/db"`, ""},
+		{"directory with trailing slash", `"db/"`, ""},
+		{"sibling prefix", `"/d"`, "Missing required key /app/d"},
+	} {
+		dir, err := ioutil.TempDir("", "topod")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+		os.Mkdir(filepath.Join(dir, "templates"), 0755)
+		dest := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+		resource := filepath.Join(dir, "conf.d", "app.toml")
+		data, _ := ioutil.ReadFile(resource)
+		ioutil.WriteFile(resource, append(data, "required_keys = ["+c.required+"]\n"...), 0644)
+		ioutil.WriteFile(dest, []byte("old"), 0644)
+		config := &Config{
+			ConfDir:     filepath.Join(dir, "conf.d"),
+			TemplateDir: filepath.Join(dir, "templates"),
+			Prefix:      "/",
+			StoreClient: st,
+		}
+		err = ProcessOnce(config)
+		if c.err == "" {
+			if err != nil || readFile(dest) != "port 80" {
+				t.Errorf("%s: ProcessOnce = %v, dest %q, expect rendered", c.name, err, readFile(dest))
+			}
+		} else {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: ProcessOnce error = %v, expect %s", c.name, err, c.err)
+			}
+			if readFile(dest) != "old" {
+				t.Errorf("%s: dest = %q, expect untouched", c.name, readFile(dest))
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -1 +1,98 @@
 package template
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/leightonwong/topod/logger"
+)
+
+/*
+* Intervaler re-process all template resources every interval seconds, instead of
+* holding long watch connections on the store. A random jitter in [0, jitter) seconds
+* is added to every wait so that a fleet of hosts does not hit the store at the same time.
+* Template resources are loaded again before a pull when conf dir or template dir changed,
+* and Reload triggers a pull with reloaded resources at once.
+ */
+type Intervaler struct {
+	config   *Config
+	interval int
+	jitter   int
+	errChan  chan error
+	reload   chan bool
+	resourceSet
+}
+
+// defaultInterval replace a pull interval which is not positive, it would pull in a busy loop
+const defaultInterval = 60
+
+func NewIntervaler(config *Config, interval, jitter int, errChan chan error) Processor {
+	if interval <= 0 {
+		logger.Log.Warning("Pull interval %d is not positive, pull every %d seconds", interval, defaultInterval)
+		interval = defaultInterval
+	}
+	return &Intervaler{
+		config: config, interval: interval, jitter: jitter, errChan: errChan,
+		reload: make(chan bool, 1),
+	}
+}
+
+// Reload load template resources again and pull now, it does not block
+func (p *Intervaler) Reload() {
+	select {
+	case p.reload <- true:
+	default:
+	}
+}
+
+func (p *Intervaler) Process(ctx context.Context) error {
+	ts, err := getTemplateResource(p.config)
+	if err != nil {
+		return errors.New("Get template resource error: " + err.Error())
+	}
+	p.setResources(ts)
+	stamp := dirStamp(p.config)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	reload := false
+	for {
+		if s := dirStamp(p.config); reload || s != stamp {
+			stamp = s
+			logger.Log.Info("Reloading template resources")
+			if loaded, err := getTemplateResource(p.config); err != nil {
+				p.errChan <- err
+			} else {
+				ts = loaded
+				p.setResources(ts)
+			}
+			reload = false
+		}
+		for _, t := range ts {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := t.process(); err != nil {
+				p.errChan <- err
+			}
+		}
+		wait := p.nextWait(random)
+		logger.Log.Debug("Process all template source done, next pull in %s", wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.reload:
+			reload = true
+		case <-time.After(wait):
+			continue
+		}
+	}
+}
+
+func (p *Intervaler) nextWait(random *rand.Rand) time.Duration {
+	wait := time.Duration(p.interval) * time.Second
+	if p.jitter > 0 {
+		wait += time.Duration(random.Int63n(int64(p.jitter) * int64(time.Second)))
+	}
+	return wait
+}
@@ -0,0 +1,71 @@
+package template
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+func TestIntervalerWait(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	p := NewIntervaler(&Config{}, 2, 3, make(chan error)).(*Intervaler)
+	for i := 0; i < 1000; i++ {
+		if wait := p.nextWait(random); wait < 2*time.Second || wait >= 5*time.Second {
+			t.Fatalf("wait %s out of [2s, 5s)", wait)
+		}
+	}
+	p = NewIntervaler(&Config{}, 2, 0, make(chan error)).(*Intervaler)
+	if wait := p.nextWait(random); wait != 2*time.Second {
+		t.Errorf("wait without jitter = %s, expect 2s", wait)
+	}
+	for _, interval := range []int{0, -5} {
+		p = NewIntervaler(&Config{}, interval, 0, make(chan error)).(*Intervaler)
+		if wait := p.nextWait(random); wait != defaultInterval*time.Second {
+			t.Errorf("wait of interval %d = %s, expect the default %ds", interval, wait, defaultInterval)
+		}
+	}
+}
+
+func TestIntervalerStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: storetest.NewClient(map[string]string{"/app/port": "80"}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- NewIntervaler(config, 3600, 0, make(chan error, 10)).Process(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for readFile(app) != "port 80" {
+		if time.Now().After(deadline) {
+			t.Fatal("resource not rendered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Process = %v, expect nil on cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not return on cancel")
+	}
+}
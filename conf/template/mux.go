@@ -0,0 +1,239 @@
+package template
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store"
+)
+
+/*
+* watchMux share store watches between template resources. One WatchPrefix loop runs
+* per watched prefix, a resource whose prefix is equal to or below a watched prefix joins
+* that watch, and a new ancestor prefix takes over the watches below it. Every change of
+* a watch is fanned out to all of its subscribers with the changed keys when the store
+* tells them.
+ */
+type watchMux struct {
+	ctx     context.Context
+	client  store.StoreClient
+	errChan chan error
+	lock    sync.Mutex
+	watches map[string]*prefixWatch
+}
+
+// prefixWatch is the single store watch of a prefix
+type prefixWatch struct {
+	prefix      string
+	index       uint64
+	cancel      context.CancelFunc
+	subscribers map[*subscription]bool
+}
+
+/*
+* subscription is the interest of one resource in the changes of its prefix. C holds
+* at most one pending notification, changes happening while the subscriber renders are
+* merged into it and read by changes. C is notified on subscribe so that the resource
+* renders once.
+ */
+type subscription struct {
+	prefix string
+	C      chan bool
+	watch  *prefixWatch
+	lock   sync.Mutex
+	keys   map[string]bool
+	//some changed keys are not known
+	unknown bool
+}
+
+func newWatchMux(ctx context.Context, client store.StoreClient, errChan chan error) *watchMux {
+	return &watchMux{ctx: ctx, client: client, errChan: errChan, watches: make(map[string]*prefixWatch)}
+}
+
+/*
+* subscribe s to the watch of prefix, or of an ancestor prefix. The current index of a new
+* watch is taken before returning, so no change made after subscribe is missed. It is
+* taken without holding the lock, a slow store does not block the other subscribers.
+ */
+func (m *watchMux) subscribe(prefix string) *subscription {
+	s := &subscription{prefix: prefix, C: make(chan bool, 1), keys: make(map[string]bool)}
+	s.notify(nil)
+	m.lock.Lock()
+	if w := m.covering(prefix); w != nil {
+		logger.Log.Debug("Prefix %s joins the watch of prefix %s", prefix, w.prefix)
+		m.join(s, w)
+		m.lock.Unlock()
+		return s
+	}
+	m.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	stop := stopChannel(ctx)
+	index, _, err := m.watchPrefix(prefix, 0, stop)
+	if err != nil {
+		logger.Log.Error("Watching prefix key %s error: %s", prefix, err.Error())
+		m.sendError(err)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	//another subscribe may have started a watch covering prefix meanwhile
+	if w := m.covering(prefix); w != nil {
+		logger.Log.Debug("Prefix %s joins the watch of prefix %s", prefix, w.prefix)
+		cancel()
+		m.join(s, w)
+		return s
+	}
+	w := &prefixWatch{prefix: prefix, index: index, cancel: cancel, subscribers: make(map[*subscription]bool)}
+	m.watches[prefix] = w
+	go m.run(ctx, w, stop)
+	m.join(s, w)
+	for p, child := range m.watches {
+		if p == prefix || !underPrefix(p, prefix) {
+			continue
+		}
+		logger.Log.Debug("Watch of prefix %s replaced by the watch of prefix %s", p, prefix)
+		child.cancel()
+		delete(m.watches, p)
+		for sub := range child.subscribers {
+			m.join(sub, w)
+			//changes between the two watches are not known
+			sub.notify(nil)
+		}
+		child.subscribers = make(map[*subscription]bool)
+	}
+	return s
+}
+
+// covering return the watch of prefix or of an ancestor of it, nil when none, the lock is held
+func (m *watchMux) covering(prefix string) *prefixWatch {
+	for _, w := range m.watches {
+		if underPrefix(prefix, w.prefix) {
+			return w
+		}
+	}
+	return nil
+}
+
+func (m *watchMux) join(s *subscription, w *prefixWatch) {
+	s.watch = w
+	w.subscribers[s] = true
+}
+
+// unsubscribe stop notifying s, the watch is stopped with its last subscriber
+func (m *watchMux) unsubscribe(s *subscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	w := s.watch
+	delete(w.subscribers, s)
+	if len(w.subscribers) == 0 && m.watches[w.prefix] == w {
+		logger.Log.Debug("Stop watching prefix %s", w.prefix)
+		w.cancel()
+		delete(m.watches, w.prefix)
+	}
+}
+
+// watching return the watched prefixes
+func (m *watchMux) watching() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	prefixes := make([]string, 0, len(m.watches))
+	for p := range m.watches {
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+func (m *watchMux) run(ctx context.Context, w *prefixWatch, stop chan bool) {
+	for {
+		logger.Log.Debug("Begin watching prefix %s with index %d", w.prefix, w.index)
+		index, keys, err := m.watchPrefix(w.prefix, w.index, stop)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if err.Error() == "unexpected end of JSON input" {
+				logger.Log.Debug("Watch connection time out, re-establish watch prefix %s", w.prefix)
+				continue
+			}
+			logger.Log.Error("Watching prefix key %s error: %s", w.prefix, err.Error())
+			m.sendError(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		logger.Log.Debug("Watching prefix key %s changed modified index %d, notify subscribers", w.prefix, index)
+		w.index = index
+		m.notify(w, keys)
+	}
+}
+
+// sendError report err on errChan, unless the mux is stopped
+func (m *watchMux) sendError(err error) {
+	select {
+	case m.errChan <- err:
+	case <-m.ctx.Done():
+	}
+}
+
+// watchPrefix watch prefix with the changed keys when the store tells them, nil keys otherwise
+func (m *watchMux) watchPrefix(prefix string, index uint64, stop chan bool) (uint64, []string, error) {
+	if client, ok := m.client.(store.KeyWatchClient); ok {
+		return client.WatchPrefixKeys(prefix, index, stop)
+	}
+	index, err := m.client.WatchPrefix(prefix, index, stop)
+	return index, nil, err
+}
+
+func (m *watchMux) notify(w *prefixWatch, keys []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for s := range w.subscribers {
+		s.notify(keys)
+	}
+}
+
+// notify add keys to the pending changes of s, nil keys when they are not known
+func (s *subscription) notify(keys []string) {
+	s.lock.Lock()
+	if keys == nil {
+		s.unknown = true
+	}
+	for _, key := range keys {
+		s.keys[key] = true
+	}
+	s.lock.Unlock()
+	select {
+	case s.C <- true:
+	default:
+	}
+}
+
+// changes take the keys changed since the last call, nil when some of them are not known
+func (s *subscription) changes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []string
+	if !s.unknown {
+		keys = make([]string, 0, len(s.keys))
+		for key := range s.keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	s.unknown = false
+	s.keys = make(map[string]bool)
+	return keys
+}
+
+// underPrefix report whether key is prefix or below it
+func underPrefix(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
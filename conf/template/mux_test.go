@@ -0,0 +1,152 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/internal/storetest"
+	"github.com/leightonwong/topod/store"
+)
+
+// countingClient count the WatchPrefix calls by prefix
+type countingClient struct {
+	store.StoreClient
+	lock    sync.Mutex
+	watches map[string]int
+}
+
+func (c *countingClient) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	c.lock.Lock()
+	c.watches[prefix]++
+	c.lock.Unlock()
+	return c.StoreClient.WatchPrefix(prefix, waitIndex, stopChan)
+}
+
+func (c *countingClient) watched() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prefixes := make([]string, 0, len(c.watches))
+	for p := range c.watches {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+func received(s *subscription) bool {
+	select {
+	case <-s.C:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestWatchMux(t *testing.T) {
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/app/db/host": "10.0.0.1", "/web/port": "8080"})
+	client := &countingClient{StoreClient: st, watches: make(map[string]int)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := newWatchMux(ctx, client, make(chan error, 10))
+
+	db := mux.subscribe("/app/db")
+	app1 := mux.subscribe("/app")
+	app2 := mux.subscribe("/app")
+	web := mux.subscribe("/web")
+	for _, s := range []*subscription{db, app1, app2, web} {
+		if !received(s) {
+			t.Fatalf("%s not notified on subscribe", s.prefix)
+		}
+	}
+	w := mux.watching()
+	sort.Strings(w)
+	if !reflect.DeepEqual(w, []string{"/app", "/web"}) {
+		t.Errorf("watching = %v, expect /app and /web", w)
+	}
+
+	st.Set("/app/db/host", "10.0.0.2")
+	for _, s := range []*subscription{db, app1, app2} {
+		if !received(s) {
+			t.Errorf("%s not notified of /app/db/host change", s.prefix)
+		}
+	}
+	select {
+	case <-web.C:
+		t.Errorf("/web notified of /app/db/host change")
+	default:
+	}
+
+	mux.unsubscribe(app1)
+	mux.unsubscribe(app2)
+	mux.unsubscribe(db)
+	if w := mux.watching(); !reflect.DeepEqual(w, []string{"/web"}) {
+		t.Errorf("watching = %v after unsubscribe, expect /web", w)
+	}
+	if w := client.watched(); !reflect.DeepEqual(w, []string{"/app", "/app/db", "/web"}) {
+		t.Errorf("store watched %v", w)
+	}
+}
+
+// slowClient block the first WatchPrefix of slow prefixes until release is closed, and fail those of bad prefixes
+type slowClient struct {
+	store.StoreClient
+	slow    string
+	bad     string
+	release chan struct{}
+}
+
+func (c *slowClient) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if prefix == c.bad {
+		return 0, errors.New("watch refused")
+	}
+	if prefix == c.slow && waitIndex == 0 {
+		<-c.release
+	}
+	return c.StoreClient.WatchPrefix(prefix, waitIndex, stopChan)
+}
+
+func TestWatchMuxSubscribeUnlocked(t *testing.T) {
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/web/port": "8080"})
+	client := &slowClient{StoreClient: st, slow: "/app", bad: "/bad", release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := make(chan error, 10)
+	mux := newWatchMux(ctx, client, errChan)
+
+	subscribed := make(chan *subscription, 2)
+	go func() { subscribed <- mux.subscribe("/app") }()
+	go func() { subscribed <- mux.subscribe("/app") }()
+	//the slow initial index of /app does not block other prefixes
+	done := make(chan *subscription)
+	go func() { done <- mux.subscribe("/web") }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscribe of /web blocked by the initial watch of /app")
+	}
+	close(client.release)
+	app1, app2 := <-subscribed, <-subscribed
+	if app1.watch != app2.watch {
+		t.Errorf("racing subscribes of /app got two watches")
+	}
+	w := mux.watching()
+	sort.Strings(w)
+	if !reflect.DeepEqual(w, []string{"/app", "/web"}) {
+		t.Errorf("watching = %v, expect /app and /web", w)
+	}
+
+	mux.subscribe("/bad")
+	select {
+	case err := <-errChan:
+		if err.Error() != "watch refused" {
+			t.Errorf("error = %v, expect watch refused", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("initial watch error not sent")
+	}
+}
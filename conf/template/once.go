@@ -0,0 +1,123 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/leightonwong/topod/logger"
+)
+
+// ErrStopped is returned by WatchOnce when ctx is done before any change
+var ErrStopped = errors.New("watch stopped before any change")
+
+/*
+* WatchOnce render every resource, wait for changes of the watched prefixes until one of
+* them re-renders a resource and return. Changes skipped by every notified resource, like
+* keys they do not consume or values they already rendered, are waited past. Prefixes are
+* watched through a watchMux, so resources under a common prefix share one store watch.
+* Indexes are taken before the first render, so a change made while rendering is not
+* missed. The returned error is the last render error of any resource, nil when all of
+* them are rendered at the end.
+ */
+func WatchOnce(ctx context.Context, config *Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ts, err := getTemplateResource(config)
+	if err != nil {
+		return err
+	}
+	errChan := make(chan error, 10)
+	go func() {
+		for {
+			select {
+			case <-errChan:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	mux := newWatchMux(ctx, config.StoreClient, errChan)
+	subs := make([]*subscription, len(ts))
+	for i, t := range ts {
+		subs[i] = mux.subscribe(t.Prefix)
+	}
+	//drop the notifications of subscribe, every resource is rendered now
+	for _, s := range subs {
+		<-s.C
+		s.changes()
+	}
+	renderErrs := make(map[*TemplateResource]error)
+	for _, t := range ts {
+		renderErrs[t] = t.process()
+	}
+
+	for rendered := false; !rendered; {
+		notified := waitNotified(ctx, subs)
+		if notified == nil {
+			return ErrStopped
+		}
+		for i, s := range subs {
+			if !notified[i] {
+				continue
+			}
+			t := ts[i]
+			logger.Log.Info("Prefix %s changed, re-render %s", t.Prefix, t.Dest)
+			ok, err := t.processChange(s.changes())
+			if ok {
+				rendered = true
+				renderErrs[t] = err
+			}
+		}
+	}
+	var lastError error
+	for _, t := range ts {
+		if err := renderErrs[t]; err != nil {
+			logger.Log.Error("Process template source %s error: %s", t.Src, err.Error())
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+// waitNotified wait for the next notification of any subscription and return the notified ones, nil when ctx is done
+func waitNotified(ctx context.Context, subs []*subscription) map[int]bool {
+	changed := make(chan int, len(subs))
+	watchCtx, stopWatches := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i, s := range subs {
+		wg.Add(1)
+		go func(i int, s *subscription) {
+			defer wg.Done()
+			select {
+			case <-s.C:
+				changed <- i
+			case <-watchCtx.Done():
+			}
+		}(i, s)
+	}
+	first := -1
+	select {
+	case first = <-changed:
+	case <-ctx.Done():
+	}
+	stopWatches()
+	wg.Wait()
+	close(changed)
+	if first < 0 {
+		return nil
+	}
+	notified := map[int]bool{first: true}
+	for i := range changed {
+		notified[i] = true
+	}
+	for i, s := range subs {
+		//notifications sent while the waiting goroutines were stopped
+		select {
+		case <-s.C:
+			notified[i] = true
+		default:
+		}
+	}
+	return notified
+}
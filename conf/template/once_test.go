@@ -0,0 +1,205 @@
+package template
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+func writeResource(t *testing.T, dir, name, prefix, text string) string {
+	dest := filepath.Join(dir, name+".conf")
+	resource := "src = \"" + name + ".tmpl\"\ndest = \"" + dest + "\"\nprefix = \"" + prefix + "\"\nkeys = [\"/\"]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.d", name+".toml"), []byte(resource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "templates", name+".tmpl"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+func readFile(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return string(data)
+}
+
+func TestWatchOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	db := writeResource(t, dir, "db", "/db", `host {{getv "/host"}}`)
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/db/host": "10.0.0.1"})
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: st,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- WatchOnce(ctx, config)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for readFile(app) != "port 80" || readFile(db) != "host 10.0.0.1" {
+		if time.Now().After(deadline) {
+			t.Fatal("resources not rendered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//db dest is not re-rendered, only the app prefix changed
+	ioutil.WriteFile(db, []byte("edited"), 0644)
+	st.Set("/app/port", "8080")
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchOnce did not return after change")
+	}
+	if readFile(app) != "port 8080" {
+		t.Errorf("app = %q, expect re-rendered", readFile(app))
+	}
+	if readFile(db) != "edited" {
+		t.Errorf("db = %q, expect untouched", readFile(db))
+	}
+}
+
+func TestWatchOnceSharedWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	db := writeResource(t, dir, "db", "/app/db", `host {{getv "/host"}}`)
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/app/db/host": "10.0.0.1"})
+	client := &countingClient{StoreClient: st, watches: make(map[string]int)}
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: client,
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- WatchOnce(context.Background(), config)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for readFile(app) != "port 80" || readFile(db) != "host 10.0.0.1" {
+		if time.Now().After(deadline) {
+			t.Fatal("resources not rendered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st.Set("/app/db/host", "10.0.0.2")
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchOnce did not return after change")
+	}
+	if readFile(db) != "host 10.0.0.2" {
+		t.Errorf("db = %q, expect re-rendered", readFile(db))
+	}
+	if w := client.watched(); !reflect.DeepEqual(w, []string{"/app"}) {
+		t.Errorf("store watched %v, expect a single watch of /app", w)
+	}
+}
+
+func TestWatchOnceSkippedChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	st := storetest.NewClient(map[string]string{"/app/port": "80"})
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: st,
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- WatchOnce(context.Background(), config)
+	}()
+	waitFor(t, "app rendered", func() bool { return readFile(app) == "port 80" })
+	//same value, the render is skipped and WatchOnce keeps waiting
+	st.Set("/app/port", "80")
+	select {
+	case err := <-result:
+		t.Fatalf("WatchOnce returned %v after a change rendering nothing", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	st.Set("/app/port", "8080")
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchOnce did not return after change")
+	}
+	if readFile(app) != "port 8080" {
+		t.Errorf("app = %q, expect re-rendered", readFile(app))
+	}
+}
+
+func TestWatchOnceStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: storetest.NewClient(nil),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := WatchOnce(ctx, config); err != ErrStopped {
+		t.Errorf("WatchOnce stopped = %v, expect %v", err, ErrStopped)
+	}
+}
+
+func TestRunCmdTimeout(t *testing.T) {
+	r := &TemplateResource{cmdTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := r.runCmd("sleep 5"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runCmd = %v, expect timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("runCmd returned after %s", elapsed)
+	}
+	if out, err := r.runCmd("echo ok"); err != nil || string(out) != "ok\n" {
+		t.Errorf("runCmd = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,44 @@
+package template
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/leightonwong/topod/memkv"
+)
+
+// Preview render the template with current store values without touching Dest or the
+// resource cache, so it is safe to call while the resource is processed
+func (t *TemplateResource) Preview() ([]byte, error) {
+	values, err := t.storeClient.GetValues(appendPrefixKeys(t.Prefix, t.Keys))
+	if err != nil {
+		return nil, err
+	}
+	cache := memkv.NewMemStore()
+	t.fillCache(cache, values)
+	funcMap := newFuncMap()
+	addFuncs(funcMap, cache.FuncMap)
+	addFuncs(funcMap, serviceFuncs(cache))
+	tmpl, err := template.New(path.Base(t.Src)).Funcs(funcMap).ParseFiles(t.Src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Consumes report whether the resource reads key, or a key under it when key is a directory
+func (t *TemplateResource) Consumes(key string) bool {
+	key = path.Join("/", key)
+	for _, k := range appendPrefixKeys(t.Prefix, t.Keys) {
+		if key == k || key == "/" || strings.HasPrefix(key, k+"/") || strings.HasPrefix(k, key+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,51 @@
 package template
 
 import (
+	"context"
+	"sync"
+
 	"github.com/leightonwong/topod/logger"
 )
 
 type Processor interface {
-	Process()
+	//Process render template resources until ctx is done or loading them fails,
+	//renders in progress finish before it returns
+	Process(ctx context.Context) error
+	//Resources return template resources loaded by the processor
+	Resources() []*TemplateResource
+}
+
+// Reloader is implemented by processors able to load template resources again without restart
+type Reloader interface {
+	Reload()
+}
+
+// resourceSet hold loaded template resources for processors, read by the management api
+type resourceSet struct {
+	lock      sync.RWMutex
+	resources []*TemplateResource
+}
+
+func (s *resourceSet) Resources() []*TemplateResource {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*TemplateResource(nil), s.resources...)
+}
+
+func (s *resourceSet) setResources(ts []*TemplateResource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.resources = ts
+}
+
+// stopChannel return a channel closed when ctx is done, for store watches which stop on a channel
+func stopChannel(ctx context.Context) chan bool {
+	stop := make(chan bool)
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+	return stop
 }
 
 func ProcessOnce(config *Config) error {
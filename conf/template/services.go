@@ -0,0 +1,146 @@
+package template
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/memkv"
+)
+
+// servicesDir is where a bare service name is looked up, the default prefix of registered services
+const servicesDir = "/services"
+
+/*
+* ServiceInstance is a registration or discovery record as seen by templates.
+* Tags and Weight come from the "tags" and "weight" metadata fields, records
+* without a healthy field, like port scanner endpoints, count as healthy.
+ */
+type ServiceInstance struct {
+	Key      string
+	Name     string
+	ID       string
+	Address  string
+	Port     int
+	Healthy  bool
+	Tags     []string
+	Weight   int
+	Metadata map[string]interface{}
+}
+
+// HasTag report whether the instance has tag
+func (s ServiceInstance) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type serviceRecord struct {
+	Name     string                 `json:"name"`
+	ID       string                 `json:"id"`
+	Address  string                 `json:"address"`
+	Port     int                    `json:"port"`
+	Healthy  *bool                  `json:"healthy"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// serviceFuncs return template functions reading service records from cache
+func serviceFuncs(cache *memkv.MemStore) map[string]interface{} {
+	services := func(name string) []ServiceInstance {
+		return parseServices(cache, name)
+	}
+	return map[string]interface{}{
+		"services": services,
+		"healthyServices": func(name string) []ServiceInstance {
+			healthy := make([]ServiceInstance, 0)
+			for _, s := range services(name) {
+				if s.Healthy {
+					healthy = append(healthy, s)
+				}
+			}
+			return healthy
+		},
+		"serviceTags": func(name string) []string {
+			seen := make(map[string]bool)
+			tags := make([]string, 0)
+			for _, s := range services(name) {
+				for _, t := range s.Tags {
+					if !seen[t] {
+						seen[t] = true
+						tags = append(tags, t)
+					}
+				}
+			}
+			sort.Strings(tags)
+			return tags
+		},
+		"sortByWeight": sortByWeight,
+	}
+}
+
+/*
+* parseServices return the instances of a service sorted by key. Name is a service name
+* looked up under /services, or a key directory when it starts with a slash. Records
+* which are not valid json are skipped with a warning, so one bad record does not break
+* the whole template.
+ */
+func parseServices(cache *memkv.MemStore, name string) []ServiceInstance {
+	dir := name
+	if !strings.HasPrefix(name, "/") {
+		dir = path.Join(servicesDir, name)
+	}
+	records := cache.GetAll(path.Join(dir, "*"))
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	instances := make([]ServiceInstance, 0, len(keys))
+	for _, k := range keys {
+		var r serviceRecord
+		if err := json.Unmarshal([]byte(records[k]), &r); err != nil {
+			logger.Log.Warning("Skipping service record %s: %s", k, err.Error())
+			continue
+		}
+		s := ServiceInstance{
+			Key:      k,
+			Name:     r.Name,
+			ID:       r.ID,
+			Address:  r.Address,
+			Port:     r.Port,
+			Healthy:  r.Healthy == nil || *r.Healthy,
+			Tags:     make([]string, 0),
+			Metadata: r.Metadata,
+		}
+		if s.ID == "" {
+			s.ID = path.Base(k)
+		}
+		if tags, ok := r.Metadata["tags"].([]interface{}); ok {
+			for _, t := range tags {
+				if tag, ok := t.(string); ok {
+					s.Tags = append(s.Tags, tag)
+				}
+			}
+		}
+		if weight, ok := r.Metadata["weight"].(float64); ok {
+			s.Weight = int(weight)
+		}
+		instances = append(instances, s)
+	}
+	return instances
+}
+
+// sortByWeight return a copy of instances, heaviest first, equal weights keep their order
+func sortByWeight(instances []ServiceInstance) []ServiceInstance {
+	sorted := make([]ServiceInstance, len(instances))
+	copy(sorted, instances)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Weight > sorted[j].Weight
+	})
+	return sorted
+}
@@ -0,0 +1,41 @@
+package template
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+
+	"github.com/leightonwong/topod/memkv"
+)
+
+func TestServiceFuncs(t *testing.T) {
+	cache := memkv.NewMemStore()
+	cache.Set("/services/web/10.0.0.1:80", `{"name":"web","id":"10.0.0.1:80","address":"10.0.0.1","port":80,"healthy":true,"metadata":{"weight":1,"tags":["v1"]}}`)
+	cache.Set("/services/web/10.0.0.2:80", `{"name":"web","id":"10.0.0.2:80","address":"10.0.0.2","port":80,"healthy":false,"metadata":{"weight":5,"tags":["v2"]}}`)
+	cache.Set("/services/web/10.0.0.3:80", `{"name":"web","id":"10.0.0.3:80","address":"10.0.0.3","port":80,"healthy":true,"metadata":{"weight":3,"tags":["v2","canary"]}}`)
+	cache.Set("/services/web/broken", `{`)
+	cache.Set("/scan/web/10.0.1.1:8080", `{"name":"web","address":"10.0.1.1","port":8080,"probe":"tcp"}`)
+	funcMap := newFuncMap()
+	addFuncs(funcMap, serviceFuncs(cache))
+	for text, expect := range map[string]string{
+		`{{range services "web"}}{{.Address}} {{end}}`:                      "10.0.0.1 10.0.0.2 10.0.0.3 ",
+		`{{range healthyServices "web"}}{{.Address}} {{end}}`:               "10.0.0.1 10.0.0.3 ",
+		`{{range sortByWeight (services "web")}}{{.Weight}} {{end}}`:        "5 3 1 ",
+		`{{range serviceTags "web"}}{{.}} {{end}}`:                          "canary v1 v2 ",
+		`{{range services "web"}}{{if .HasTag "v2"}}{{.ID}} {{end}}{{end}}`: "10.0.0.2:80 10.0.0.3:80 ",
+		`{{range healthyServices "/scan/web"}}{{.ID}} {{.Port}}{{end}}`:     "10.0.1.1:8080 8080",
+		`{{len (services "missing")}}`:                                      "0",
+	} {
+		tmpl, err := template.New("test").Funcs(funcMap).Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, nil); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		if buf.String() != expect {
+			t.Errorf("%s = %q, expect %q", text, buf.String(), expect)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package template
+
+import (
+	"time"
+)
+
+// ResourceStatus is the last render result of a template resource
+type ResourceStatus struct {
+	Src        string    `json:"src"`
+	Dest       string    `json:"dest"`
+	Prefix     string    `json:"prefix"`
+	Keys       []string  `json:"keys"`
+	Renders    int       `json:"renders"`
+	LastRender time.Time `json:"last_render"`
+	LastUpdate time.Time `json:"last_update"`
+	LastError  string    `json:"last_error"`
+}
+
+// Status return a copy of the resource render status, safe to call while it is processed
+func (t *TemplateResource) Status() ResourceStatus {
+	t.statusLock.RLock()
+	defer t.statusLock.RUnlock()
+	status := t.status
+	status.Src = t.Src
+	status.Dest = t.Dest
+	status.Prefix = t.Prefix
+	status.Keys = append([]string(nil), t.Keys...)
+	return status
+}
+
+func (t *TemplateResource) recordStatus(err error) {
+	t.statusLock.Lock()
+	defer t.statusLock.Unlock()
+	t.status.Renders++
+	t.status.LastRender = time.Now()
+	if err != nil {
+		t.status.LastError = err.Error()
+	} else {
+		t.status.LastError = ""
+	}
+}
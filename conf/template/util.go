@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -104,3 +105,26 @@ func backupFile(src, backupDir string) (string, error) {
 		return backup, err
 	}
 }
+
+// fileStamp identify the content version of a file by modification time and size, empty when missing
+func fileStamp(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %d", path, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// dirStamp change whenever a resource toml of conf dir or a file of template dir is added, removed or modified
+func dirStamp(config *Config) string {
+	var stamps []string
+	for _, dir := range []string{config.ConfDir, config.TemplateDir} {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				stamps = append(stamps, fileStamp(path))
+			}
+			return nil
+		})
+	}
+	return strings.Join(stamps, "\n")
+}
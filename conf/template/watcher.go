@@ -1,58 +1,172 @@
 package template
 
 import (
-	"sync"
+	"context"
+	"errors"
+	"sort"
+	"time"
 
 	"github.com/leightonwong/topod/logger"
 )
 
+// reloadInterval is how often conf dir and template dir are checked for changes
+const reloadInterval = 2 * time.Second
+
+/*
+* Watcher monitor the prefix of every template resource and render it on change.
+* Resources share one store watch per prefix through a watch multiplexer, so resources
+* under the same prefix do not open identical watches.
+* Conf dir and template dir are polled, and Reload forces a check, so new resources
+* start being monitored, removed ones stop, and a resource whose toml or template
+* source changed is restarted, which renders it again.
+ */
 type Watcher struct {
-	config   *Config
-	stopChan chan bool
-	doneChan chan bool
-	errChan  chan error
-	wg       *sync.WaitGroup
+	config     *Config
+	errChan    chan error
+	reloadChan chan bool
+	monitors   map[string]*monitor
+	mux        *watchMux
+	resourceSet
+}
+
+// monitor is the watch goroutine of one resource, keyed by its toml path
+type monitor struct {
+	resource *TemplateResource
+	stamp    string
+	cancel   context.CancelFunc
+	done     chan bool
 }
 
-func NewWatcher(config *Config, stopChan, doneChan chan bool, errChan chan error) Processor {
-	var wg sync.WaitGroup
+func NewWatcher(config *Config, errChan chan error) Processor {
 	return &Watcher{
-		config, stopChan, doneChan, errChan, &wg,
+		config: config, errChan: errChan,
+		reloadChan: make(chan bool, 1), monitors: make(map[string]*monitor),
 	}
 }
 
-func (w *Watcher) Process() {
-	defer close(w.doneChan)
-	ts, err := getTemplateResource(w.config)
-	if err != nil {
-		logger.Log.Error("Get template resource error: %s", err.Error())
-		return
-	}
-	for _, t := range ts {
-		w.wg.Add(1)
-		go w.monitorPrefix(t)
+// Reload check template resources for changes now, it does not block
+func (w *Watcher) Reload() {
+	select {
+	case w.reloadChan <- true:
+	default:
 	}
-	w.wg.Wait()
 }
 
-func (p *Watcher) monitorPrefix(t *TemplateResource) {
-	defer p.wg.Done()
+func (w *Watcher) Process(ctx context.Context) error {
+	w.mux = newWatchMux(ctx, w.config.StoreClient, w.errChan)
+	stamp := dirStamp(w.config)
+	if err := w.reload(ctx); err != nil {
+		w.stopMonitors()
+		return errors.New("Get template resource error: " + err.Error())
+	}
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
 	for {
-		logger.Log.Debug("Begin watching prefix %s with index %d", t.Prefix, t.lastIndex)
-		index, err := p.config.StoreClient.WatchPrefix(t.Prefix, t.lastIndex, p.stopChan)
-		if err != nil {
-			if err.Error() == "unexpected end of JSON input" {
-				logger.Log.Debug("Watch connection time out, re-establish watch prefix %s", t.Prefix)
+		select {
+		case <-ctx.Done():
+			w.stopMonitors()
+			return nil
+		case <-w.reloadChan:
+			logger.Log.Notice("Reloading template resources")
+		case <-ticker.C:
+			if s := dirStamp(w.config); s == stamp {
 				continue
 			}
-			logger.Log.Error("Watching prefix key %s error: %s", t.Prefix, err.Error())
-			p.errChan <- err
+			logger.Log.Info("Template resources changed, reloading")
+		}
+		stamp = dirStamp(w.config)
+		if err := w.reload(ctx); err != nil {
+			w.errChan <- err
+		}
+	}
+}
+
+/*
+* reload start monitors of new and changed resources and stop the ones of changed and
+* removed resources. A resource whose toml fails to load keeps its running monitor.
+ */
+func (w *Watcher) reload(ctx context.Context) error {
+	paths, err := resourcePaths(w.config)
+	if err != nil {
+		return err
+	}
+	var lastError error
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		seen[path] = true
+		t, err := NewConfigTemplate(path, w.config)
+		if err != nil {
+			lastError = err
+			continue
+		}
+		stamp := fileStamp(path) + "|" + fileStamp(t.Src)
+		m, ok := w.monitors[path]
+		if ok && m.stamp == stamp {
 			continue
 		}
-		logger.Log.Debug("Watching prefix key %s changed modified index %d, ready to process", t.Prefix, index)
-		t.lastIndex = index
-		if err := t.process(); err != nil {
-			p.errChan <- err
+		if ok {
+			logger.Log.Info("Template resource %s changed, restarting its watch", path)
+			m.halt()
+		}
+		monitorCtx, cancel := context.WithCancel(ctx)
+		m = &monitor{resource: t, stamp: stamp, cancel: cancel, done: make(chan bool)}
+		w.monitors[path] = m
+		go w.monitorPrefix(monitorCtx, t, m.done)
+	}
+	for path, m := range w.monitors {
+		if !seen[path] {
+			logger.Log.Info("Template resource %s removed, stopping its watch", path)
+			m.halt()
+			delete(w.monitors, path)
+		}
+	}
+	w.setResources(w.monitored())
+	return lastError
+}
+
+// monitored return resources of running monitors ordered by toml path
+func (w *Watcher) monitored() []*TemplateResource {
+	paths := make([]string, 0, len(w.monitors))
+	for path := range w.monitors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ts := make([]*TemplateResource, len(paths))
+	for i, path := range paths {
+		ts[i] = w.monitors[path].resource
+	}
+	return ts
+}
+
+func (w *Watcher) stopMonitors() {
+	for path, m := range w.monitors {
+		m.halt()
+		delete(w.monitors, path)
+	}
+}
+
+// halt stop the monitor and wait for a render in progress to finish
+func (m *monitor) halt() {
+	m.cancel()
+	<-m.done
+}
+
+// monitorPrefix render t on subscribe and on changes of its keys notified by the watch of its prefix
+func (w *Watcher) monitorPrefix(ctx context.Context, t *TemplateResource, done chan bool) {
+	defer close(done)
+	sub := w.mux.subscribe(t.Prefix)
+	defer w.mux.unsubscribe(sub)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.C:
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := t.processChange(sub.changes()); err != nil {
+			w.errChan <- err
 		}
 	}
 }
@@ -0,0 +1,182 @@
+package template
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/internal/storetest"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	app := writeResource(t, dir, "app", "/app", `port {{getv "/port"}}`)
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/db/host": "10.0.0.1"})
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: st,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	w := NewWatcher(config, make(chan error, 10)).(*Watcher)
+	go func() {
+		result <- w.Process(ctx)
+	}()
+	waitFor(t, "app render", func() bool { return readFile(app) == "port 80" })
+
+	//new resource
+	db := writeResource(t, dir, "db", "/db", `host {{getv "/host"}}`)
+	w.Reload()
+	waitFor(t, "new db resource render", func() bool { return readFile(db) == "host 10.0.0.1" })
+	if n := len(w.Resources()); n != 2 {
+		t.Errorf("resources = %d, expect 2", n)
+	}
+
+	//changed template source
+	writeResource(t, dir, "app", "/app", `listen {{getv "/port"}}`)
+	w.Reload()
+	waitFor(t, "changed app template render", func() bool { return readFile(app) == "listen 80" })
+
+	//removed resource no longer renders
+	os.Remove(filepath.Join(dir, "conf.d", "db.toml"))
+	w.Reload()
+	waitFor(t, "db resource removal", func() bool { return len(w.Resources()) == 1 })
+	st.Set("/db/host", "10.0.0.2")
+	st.Set("/app/port", "8080")
+	waitFor(t, "app render after change", func() bool { return readFile(app) == "listen 8080" })
+	if readFile(db) != "host 10.0.0.1" {
+		t.Errorf("removed db resource rendered %q", readFile(db))
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("stopped watcher returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher not stopped")
+	}
+}
+
+// fetchCountingClient count GetValues calls and record the highest index watched through the test store
+type fetchCountingClient struct {
+	*storetest.Client
+	fetches int32
+	watched uint64
+}
+
+func (c *fetchCountingClient) GetValues(keys []string) (map[string]string, error) {
+	atomic.AddInt32(&c.fetches, 1)
+	return c.Client.GetValues(keys)
+}
+
+func (c *fetchCountingClient) WatchPrefixKeys(prefix string, waitIndex uint64, stopChan chan bool) (uint64, []string, error) {
+	for {
+		watched := atomic.LoadUint64(&c.watched)
+		if waitIndex <= watched || atomic.CompareAndSwapUint64(&c.watched, watched, waitIndex) {
+			break
+		}
+	}
+	return c.Client.WatchPrefixKeys(prefix, waitIndex, stopChan)
+}
+
+func (c *fetchCountingClient) fetched() int32 {
+	return atomic.LoadInt32(&c.fetches)
+}
+
+// waitTaken wait until the changes up to index are taken by the subscribers of w, a render may still run
+func waitTaken(t *testing.T, w *Watcher, client *fetchCountingClient, index uint64) {
+	waitFor(t, "changes taken", func() bool {
+		if atomic.LoadUint64(&client.watched) < index {
+			return false
+		}
+		w.mux.lock.Lock()
+		defer w.mux.lock.Unlock()
+		for _, watch := range w.mux.watches {
+			for s := range watch.subscribers {
+				s.lock.Lock()
+				pending := len(s.C) > 0 || len(s.keys) > 0 || s.unknown
+				s.lock.Unlock()
+				if pending {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func TestWatcherSkipUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	os.Mkdir(filepath.Join(dir, "templates"), 0755)
+	dest := filepath.Join(dir, "app.conf")
+	resource := "src = \"app.tmpl\"\ndest = \"" + dest + "\"\nprefix = \"/app\"\nkeys = [\"/port\"]\n"
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "app.toml"), []byte(resource), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "templates", "app.tmpl"), []byte(`port {{getv "/port"}}`), 0644)
+	st := storetest.NewClient(map[string]string{"/app/port": "80", "/app/name": "web"})
+	client := &fetchCountingClient{Client: st}
+	config := &Config{
+		ConfDir:     filepath.Join(dir, "conf.d"),
+		TemplateDir: filepath.Join(dir, "templates"),
+		Prefix:      "/",
+		StoreClient: client,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := NewWatcher(config, make(chan error, 10)).(*Watcher)
+	go w.Process(ctx)
+	renders := func() int {
+		ts := w.Resources()
+		if len(ts) == 0 {
+			return 0
+		}
+		return ts[0].Status().Renders
+	}
+	waitFor(t, "app render", func() bool { return renders() == 1 })
+
+	fetches := client.fetched()
+
+	//key not consumed by the resource, skipped without a fetch
+	index, _ := st.Set("/app/name", "api")
+	waitTaken(t, w, client, index)
+	//consumed key written with the same value, fetched and skipped
+	index, _ = st.Set("/app/port", "80")
+	waitTaken(t, w, client, index)
+	//changes are processed in order, a render of the skipped ones would be the second with port 80
+	st.Set("/app/port", "8080")
+	waitFor(t, "second app render", func() bool { return renders() == 2 })
+	if content := readFile(dest); content != "port 8080" {
+		t.Errorf("second render wrote %q after unconsumed and unchanged keys, expect port 8080", content)
+	}
+	if n := client.fetched() - fetches; n != 2 {
+		t.Errorf("fetches = %d for the unconsumed, unchanged and changed keys, expect 2", n)
+	}
+}
@@ -1,24 +1,29 @@
 package main
 
 import (
+	"errors"
 	//"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
-	//"strconv"
-	//"strings"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/voxelbrain/goptions"
 
 	"github.com/leightonwong/topod/conf/template"
+	"github.com/leightonwong/topod/discovery"
 	"github.com/leightonwong/topod/logger"
 	storage "github.com/leightonwong/topod/store"
 )
 
 var (
-	configFile         = ""
 	defaultConfigFile  = "/etc/topod/topod.toml"
 	configDir          = ""
 	defaultConfigDir   = "/etc/topod/conf.d/"
@@ -57,16 +62,60 @@ func (n *Nodes) Set(node string) error {
 
 //Use goptions instead of flag to parse command
 type WatchOptions struct {
-	Once bool `goptions:"-o, --once, description='watch once , when changed regenerate config file and exit'"`
+	Once bool `goptions:"-o, --once, description='render, wait for the first change, regenerate changed config files and exit'"`
 }
 type PullOptions struct {
 	Interval int `goptions:"-i, --interval, obligatory, description='pull config from remote server, in seconds'"`
+	Jitter   int `goptions:"-j, --jitter, description='add a random delay up to jitter seconds to every pull'"`
 }
 type GenOptions struct {
 }
+type GetOptions struct {
+	Json bool `goptions:"-j, --json, description='print values as json'"`
+	goptions.Remainder
+}
+type SetOptions struct {
+	Index  uint64 `goptions:"-i, --index, description='only set when key modified index equals index'"`
+	Create bool   `goptions:"--create, description='only set when key does not exist'"`
+	goptions.Remainder
+}
+type RmOptions struct {
+	Recursive bool `goptions:"-r, --recursive, description='remove key and all keys under it'"`
+	goptions.Remainder
+}
+type LsOptions struct {
+	Json bool `goptions:"-j, --json, description='print key tree as json'"`
+	goptions.Remainder
+}
+type ExportOptions struct {
+	Prefix string `goptions:"-p, --prefix, description='key path prefix to export'"`
+	Format string `goptions:"-f, --format, description='output format yaml, json or toml, default yaml'"`
+}
+type ImportOptions struct {
+	Prefix string `goptions:"-p, --prefix, description='key path prefix to import into'"`
+	DryRun bool   `goptions:"-n, --dry-run, description='only show pending changes'"`
+	Delete bool   `goptions:"--delete, description='delete keys under prefix absent from the file'"`
+	goptions.Remainder
+}
+type RegisterOptions struct {
+	Name      string `goptions:"--name, description='service name'"`
+	ID        string `goptions:"--id, description='service instance id, default address:port'"`
+	Address   string `goptions:"-a, --address, description='service address, default first non loopback ipv4 address'"`
+	Port      int    `goptions:"--port, description='service port'"`
+	Metadata  string `goptions:"-m, --metadata, description='service metadata json'"`
+	Prefix    string `goptions:"-p, --prefix, description='services key prefix, default /services'"`
+	TTL       int    `goptions:"-t, --ttl, description='record ttl in seconds, default 30'"`
+	Heartbeat int    `goptions:"--heartbeat, description='record refresh interval in seconds, default ttl/3'"`
+	Check     string `goptions:"--check, description='health check type tcp, http or exec, only registered while healthy'"`
+	CheckURL  string `goptions:"--check-url, description='http check url, default http://address:port/'"`
+	CheckBody string `goptions:"--check-body, description='regexp the http check response body must match'"`
+	CheckCmd  string `goptions:"--check-command, description='exec check shell command, healthy on exit code 0'"`
+}
+type ConfigOptions struct {
+}
 type CommandOptions struct {
-	Store      string `goptions:"-s, --store, description='remote conf store to use, etcd or consule'"`
-	StoreNodes Nodes  `goptions:"-N, --nodes, description='remote storage uri, format host:port, host:port'"`
+	Store      string `goptions:"-s, --store, description='remote conf store to use, etcd, etcdv3, consul, redis, zookeeper, vault, file or env'"`
+	StoreNodes Nodes  `goptions:"-N, --nodes, description='remote storage uri, format host:port, host:port, or file paths for file store'"`
 	Schema     string `goptions:"-m, --schema, description='remote storage service schema(http|https)'"`
 	Config     string `goptions:"-c, --config, description='topod config file path'"`
 	ConfDir    string `goptions:"-d, --confdir, description='topod config directory'"`
@@ -79,15 +128,46 @@ type CommandOptions struct {
 	Version bool          `goptions:"-V, --version, description='print version and exit'"`
 	Help    goptions.Help `goptions:"-h, --help, description='show help'"`
 	goptions.Verbs
-	Watch WatchOptions `goptions:"watch"`
-	Pull  PullOptions  `goptions:"pull"`
-	Gen   GenOptions   `goptions:"gen"`
+	Watch  WatchOptions  `goptions:"watch"`
+	Pull   PullOptions   `goptions:"pull"`
+	Gen    GenOptions    `goptions:"gen"`
+	Get    GetOptions    `goptions:"get"`
+	Set    SetOptions    `goptions:"set"`
+	Rm     RmOptions     `goptions:"rm"`
+	Ls     LsOptions     `goptions:"ls"`
+	Export ExportOptions `goptions:"export"`
+	Import ImportOptions `goptions:"import"`
+	//publish a service record until interrupted
+	Register RegisterOptions `goptions:"register"`
+	//print the effective config
+	ConfigVerb ConfigOptions `goptions:"config"`
+}
+
+type APIConfig struct {
+	Listen string `toml:"listen"`
+	//bearer token required by every api request
+	Token string `toml:"token"`
+	//serve https, and require client certificates signed by client_ca
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	ClientCA string `toml:"client_ca"`
 }
 
 type Config struct {
 	Store      string   `toml:"store"`
 	StoreNodes []string `toml:"nodes"`
-	Schema     string   `toma:"schema"`
+	Schema     string   `toml:"schema"`
+	Cert       string   `toml:"client_cert"`
+	Key        string   `toml:"client_key"`
+	CaKeys     string   `toml:"client_cakeys"`
+	Token      string   `toml:"token"`
+	Password   string   `toml:"password"`
+	DB         int      `toml:"db"`
+	AuthType   string   `toml:"auth_type"`
+	RoleID     string   `toml:"role_id"`
+	SecretID   string   `toml:"secret_id"`
+	KVVersion  int      `toml:"kv_version"`
+	Gateway    string   `toml:"gateway_prefix"`
 	ConfDir    string   `toml:"confdir"`
 	Debug      bool     `toml:"debug"`
 	Prefix     string   `toml:"prefix"`
@@ -96,6 +176,13 @@ type Config struct {
 	Gen        GenOptions
 	Verbose    bool `toml:"verbose"`
 	Noop       bool `toml:"noop"`
+	CmdTimeout int  `toml:"cmd_timeout"`
+	//management api is enabled when listen address is set
+	API APIConfig `toml:"api"`
+	//port scanners writing discovered endpoints to the store
+	Discovery []discovery.Config `toml:"discovery"`
+	//services published with a ttl while topod runs
+	Register []discovery.RegisterConfig `toml:"register"`
 }
 
 func init() {
@@ -130,62 +217,206 @@ func init() {
 }
 
 /*
-* First init default config then override from config file and then overriding from flag set on the command line.
+* Load config in layers, each overriding the previous one: defaults, the config file given
+* by -c or the default one when it exists, TOPOD_* environment variables and flags set on
+* the command line. The effective config is validated before the store and template
+* configs are derived from it.
  */
 func initConfig() error {
-	if configFile == "" {
-		if _, err := os.Stat(defaultConfigFile); !os.IsNotExist(err) {
-			configFile = defaultConfigFile
-		}
+	c, err := loadConfig(options, os.Environ())
+	if err != nil {
+		return err
 	}
-	//init config struct
-	config = Config{
+	config = c
+	storeConfig = storage.Config{
+		Store:     config.Store,
+		Nodes:     config.StoreNodes,
+		Schema:    config.Schema,
+		Cert:      config.Cert,
+		Key:       config.Key,
+		CaKeys:    config.CaKeys,
+		Token:     config.Token,
+		Password:  config.Password,
+		DB:        config.DB,
+		AuthType:  config.AuthType,
+		RoleID:    config.RoleID,
+		SecretID:  config.SecretID,
+		KVVersion: config.KVVersion,
+		Gateway:   config.Gateway,
+	}
+	templateConfig = template.Config{
+		ParentDir:   config.ConfDir,
+		ConfDir:     filepath.Join(config.ConfDir, "conf.d"),
+		TemplateDir: filepath.Join(config.ConfDir, "templates"),
+		Prefix:      config.Prefix,
+		Noop:        config.Noop,
+		//0 lets check_cmd and reload_cmd run without limit
+		CommandTimeout: time.Duration(config.CmdTimeout) * time.Second,
+	}
+	return nil
+}
+
+func loadConfig(options CommandOptions, environ []string) (Config, error) {
+	c := Config{
 		Store:      "etcd",
-		StoreNodes: []string{"127.0.0.1:4001"},
 		Schema:     "http",
 		ConfDir:    defaultConfigDir,
 		Prefix:     "/",
+		CmdTimeout: 60,
+	}
+	configFile := options.Config
+	if configFile == "" {
+		if _, err := os.Stat(defaultConfigFile); !os.IsNotExist(err) {
+			configFile = defaultConfigFile
+		}
 	}
-	//update config from config file
 	if configFile == "" {
 		logger.Log.Warning("Skiping config file, file not specified")
 	} else {
 		logger.Log.Debug("Start loading config file " + configFile)
 		configBytes, err := ioutil.ReadFile(configFile)
 		if err != nil {
-			//logger.Log.Warning("Reading config file %s error : %s, use empty config instead", configFile, err.Error())
-			return err
+			return c, err
 		}
-		_, err = toml.Decode(string(configBytes), &config)
-		if err != nil {
-			return err
+		if _, err := toml.Decode(string(configBytes), &c); err != nil {
+			return c, fmt.Errorf("config file %s: %s", configFile, err.Error())
+		}
+	}
+	if err := processEnv(reflect.ValueOf(&c).Elem(), envPrefix, environ); err != nil {
+		return c, err
+	}
+	processOptions(&c, options)
+	if len(c.StoreNodes) == 0 {
+		c.StoreNodes = append([]string(nil), defaultNodes[c.Store]...)
+	}
+	return c, validateConfig(&c)
+}
+
+//default store nodes when none is configured, file and env stores have no default
+var defaultNodes = map[string][]string{
+	"consul":    {"127.0.0.1:8500"},
+	"consule":   {"127.0.0.1:8500"},
+	"etcd":      {"127.0.0.1:4001"},
+	"etcdv3":    {"127.0.0.1:2379"},
+	"redis":     {"127.0.0.1:6379"},
+	"zookeeper": {"127.0.0.1:2181"},
+	"vault":     {"127.0.0.1:8200"},
+}
+
+const envPrefix = "TOPOD"
+
+/*
+* processEnv override fields of v from environment variables named after their toml keys,
+* TOPOD_STORE for store or TOPOD_API_LISTEN for listen of the api table. String lists are
+* comma separated, tables other than plain structs like [[register]] are file only.
+ */
+func processEnv(v reflect.Value, prefix string, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
 		}
 	}
-	//update config from command line
-	//processFlags()
-	processOptions()
-	//get store service uri from some other service
+	return setFromEnv(v, prefix, env)
+}
 
-	if len(config.StoreNodes) == 0 {
-		switch config.Store {
-		case "consule":
-			config.StoreNodes = []string{"127.0.0.1:8500"}
-		case "etcd":
-			config.StoreNodes = []string{"127.0.0.1:4001"}
+func setFromEnv(v reflect.Value, prefix string, env map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("toml")
+		if tag == "" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := setFromEnv(field, name, env); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := env[name]
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer %q", name, value)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid boolean %q", name, value)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			list := make([]string, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
 		}
 	}
+	return nil
+}
 
-	storeConfig = storage.Config{
-		Store:  config.Store,
-		Nodes:  config.StoreNodes,
-		Schema: config.Schema,
+// validateConfig check the effective config, errors name the offending toml key
+func validateConfig(c *Config) error {
+	stores := []string{"etcd", "etcdv3", "consul", "redis", "zookeeper", "vault", "file", "env"}
+	known := c.Store == "consule"
+	for _, s := range stores {
+		known = known || c.Store == s
 	}
-	templateConfig = template.Config{
-		ParentDir:   config.ConfDir,
-		ConfDir:     filepath.Join(config.ConfDir, "conf.d"),
-		TemplateDir: filepath.Join(config.ConfDir, "templates"),
-		Prefix:      config.Prefix,
-		Noop:        config.Noop,
+	if !known {
+		return fmt.Errorf("config store: unknown store %q, expect one of %s", c.Store, strings.Join(stores, ", "))
+	}
+	if c.Schema != "" && c.Schema != "http" && c.Schema != "https" {
+		return fmt.Errorf("config schema: %q is not http or https", c.Schema)
+	}
+	if len(c.StoreNodes) == 0 && c.Store != "env" {
+		return fmt.Errorf("config nodes: %s store needs at least one node", c.Store)
+	}
+	if c.ConfDir == "" {
+		return errors.New("config confdir: must not be empty")
+	}
+	if c.CmdTimeout < 0 {
+		return fmt.Errorf("config cmd_timeout: %d is negative", c.CmdTimeout)
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("config db: %d is negative", c.DB)
+	}
+	if c.KVVersion < 0 || c.KVVersion > 2 {
+		return fmt.Errorf("config kv_version: %d is not 1 or 2, or 0 to detect", c.KVVersion)
+	}
+	switch c.Gateway {
+	case "", "/v3", "/v3beta", "/v3alpha":
+	default:
+		return fmt.Errorf("config gateway_prefix: %q is not /v3, /v3beta or /v3alpha", c.Gateway)
+	}
+	switch c.AuthType {
+	case "", "token", "approle", "cert":
+	default:
+		return fmt.Errorf("config auth_type: unknown auth type %q, expect token, approle or cert", c.AuthType)
+	}
+	if c.API.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.API.Listen); err != nil {
+			return fmt.Errorf("config api.listen: %s", err.Error())
+		}
+	}
+	if (c.API.Cert == "") != (c.API.Key == "") {
+		return errors.New("config api.cert: cert and key must be set together")
+	}
+	if c.API.ClientCA != "" && c.API.Cert == "" {
+		return errors.New("config api.client_ca: requires api.cert and api.key")
 	}
 	return nil
 }
@@ -222,7 +453,7 @@ func updateConfigFromFlag(f *flag.Flag) {
 	}
 }
 */
-func processOptions() {
+func processOptions(config *Config, options CommandOptions) {
 	if options.Store != "" {
 		config.Store = options.Store
 	}
@@ -254,5 +485,23 @@ func processOptions() {
 		config.Gen = options.Gen
 	case "pull":
 		config.Pull = options.Pull
+	case "export":
+		if options.Export.Prefix != "" {
+			config.Prefix = options.Export.Prefix
+		}
+	case "import":
+		if options.Import.Prefix != "" {
+			config.Prefix = options.Import.Prefix
+		}
+	}
+}
+
+// printConfig write the effective config as toml, with secrets masked
+func printConfig(c Config, w io.Writer) error {
+	for _, secret := range []*string{&c.Token, &c.Password, &c.SecretID, &c.API.Token} {
+		if *secret != "" {
+			*secret = "******"
+		}
 	}
+	return toml.NewEncoder(w).Encode(c)
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -15,11 +20,100 @@ func TestInitDefaultConfig(t *testing.T) {
 		Verbose:    false,
 		Noop:       false,
 		Debug:      false,
+		CmdTimeout: 60,
 	}
 	if err := initConfig(); err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	if !reflect.DeepEqual(config, expect) {
 		t.Errorf("Init default config = %v, expect, %v", config, expect)
 	}
 }
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "topod.toml")
+	ioutil.WriteFile(file, []byte(`
+store = "redis"
+schema = "https"
+prefix = "/file"
+db = 1
+confdir = "/srv/topod"
+
+[api]
+listen = "127.0.0.1:8080"
+`), 0644)
+
+	c, err := loadConfig(CommandOptions{Config: file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Store != "redis" || c.Schema != "https" || c.DB != 1 || c.API.Listen != "127.0.0.1:8080" {
+		t.Errorf("file layer = %+v", c)
+	}
+	if !reflect.DeepEqual(c.StoreNodes, []string{"127.0.0.1:6379"}) {
+		t.Errorf("default redis nodes = %v", c.StoreNodes)
+	}
+
+	environ := []string{"TOPOD_PREFIX=/env", "TOPOD_DB=2", "TOPOD_NODES=10.0.0.1:6379, 10.0.0.2:6379", "TOPOD_API_LISTEN=:9090", "OTHER=1"}
+	c, err = loadConfig(CommandOptions{Config: file}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Prefix != "/env" || c.DB != 2 || c.API.Listen != ":9090" || c.ConfDir != "/srv/topod" {
+		t.Errorf("env layer = %+v", c)
+	}
+	if !reflect.DeepEqual(c.StoreNodes, []string{"10.0.0.1:6379", "10.0.0.2:6379"}) {
+		t.Errorf("env nodes = %v", c.StoreNodes)
+	}
+
+	c, err = loadConfig(CommandOptions{Config: file, Prefix: "/flag", StoreNodes: Nodes{"10.0.0.3:6379"}}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Prefix != "/flag" || !reflect.DeepEqual(c.StoreNodes, []string{"10.0.0.3:6379"}) {
+		t.Errorf("flag layer = %+v", c)
+	}
+
+	if _, err := loadConfig(CommandOptions{Config: filepath.Join(dir, "missing.toml")}, nil); err == nil {
+		t.Errorf("missing config file given by -c expect error")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for environ, field := range map[string]string{
+		"TOPOD_STORE=etcd3":        "store",
+		"TOPOD_SCHEMA=ftp":         "schema",
+		"TOPOD_STORE=file":         "nodes",
+		"TOPOD_DB=x":               "TOPOD_DB",
+		"TOPOD_DEBUG=maybe":        "TOPOD_DEBUG",
+		"TOPOD_KV_VERSION=3":       "kv_version",
+		"TOPOD_AUTH_TYPE=ldap":     "auth_type",
+		"TOPOD_GATEWAY_PREFIX=/v2": "gateway_prefix",
+		"TOPOD_API_LISTEN=nowhere": "api.listen",
+	} {
+		_, err := loadConfig(CommandOptions{}, []string{environ})
+		if err == nil {
+			t.Errorf("%s expect error", environ)
+			continue
+		}
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("%s error %q does not name %s", environ, err.Error(), field)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printConfig(Config{Store: "vault", Token: "s.secret", Schema: "https"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "s.secret") || !strings.Contains(out, `store = "vault"`) || !strings.Contains(out, `schema = "https"`) {
+		t.Errorf("printConfig = %s", out)
+	}
+}
@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxCheckBody bound the http response body read for body matching
+const maxCheckBody = 64 * 1024
+
+// CheckConfig of the health check of a registered service, from a [register.check] table
+type CheckConfig struct {
+	Type     string `toml:"type"`
+	Address  string `toml:"address"`
+	URL      string `toml:"url"`
+	Status   int    `toml:"status"`
+	Body     string `toml:"body"`
+	Command  string `toml:"command"`
+	Interval int    `toml:"interval"`
+	Timeout  int    `toml:"timeout_ms"`
+	Rise     int    `toml:"rise"`
+	Fall     int    `toml:"fall"`
+	//keep the record with healthy false instead of withdrawing it when the service fails
+	Mark bool `toml:"mark"`
+}
+
+// setDefaults fill unset fields, address and port are the registered service ones
+func (c *CheckConfig) setDefaults(address string, port, heartbeat int) {
+	target := net.JoinHostPort(address, strconv.Itoa(port))
+	if c.Address == "" {
+		c.Address = target
+	}
+	if c.URL == "" {
+		c.URL = "http://" + target + "/"
+	}
+	if c.Interval <= 0 {
+		c.Interval = heartbeat
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 2000
+	}
+	if c.Rise <= 0 {
+		c.Rise = 2
+	}
+	if c.Fall <= 0 {
+		c.Fall = 3
+	}
+}
+
+func (c *CheckConfig) validate() error {
+	switch c.Type {
+	case "tcp", "http":
+	case "exec":
+		if c.Command == "" {
+			return fmt.Errorf("exec check command required")
+		}
+	default:
+		return fmt.Errorf("unknown check type %s, tcp, http or exec", c.Type)
+	}
+	if c.Body != "" {
+		if _, err := regexp.Compile(c.Body); err != nil {
+			return fmt.Errorf("check body: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+* Check probe a service and keep its health state. The first probe sets the state,
+* after that the state only turns healthy after rise consecutive passes and turns
+* unhealthy after fall consecutive failures, so a flapping service does not flap
+* its record.
+ */
+type Check struct {
+	config  CheckConfig
+	body    *regexp.Regexp
+	http    *http.Client
+	probed  bool
+	healthy bool
+	passes  int
+	fails   int
+}
+
+func newCheck(config CheckConfig) *Check {
+	c := &Check{
+		config: config,
+		http:   &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond},
+	}
+	if config.Body != "" {
+		c.body = regexp.MustCompile(config.Body)
+	}
+	return c
+}
+
+// Healthy return the current health state
+func (c *Check) Healthy() bool {
+	return c.healthy
+}
+
+// Update probe the service once and return whether the health state changed, and the probe error
+func (c *Check) Update() (bool, error) {
+	err := c.probe()
+	if !c.probed {
+		c.probed = true
+		c.healthy = err == nil
+		return true, err
+	}
+	if err == nil {
+		c.passes++
+		c.fails = 0
+	} else {
+		c.fails++
+		c.passes = 0
+	}
+	switch {
+	case !c.healthy && c.passes >= c.config.Rise:
+		c.healthy = true
+		return true, err
+	case c.healthy && c.fails >= c.config.Fall:
+		c.healthy = false
+		return true, err
+	}
+	return false, err
+}
+
+func (c *Check) probe() error {
+	timeout := time.Duration(c.config.Timeout) * time.Millisecond
+	switch c.config.Type {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", c.config.Address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		return c.probeHttp()
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c.config.Command)
+		//do not wait for children of the shell still holding the output after a kill
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s %s", c.config.Command, err.Error(), out)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown check type %s", c.config.Type)
+}
+
+func (c *Check) probeHttp() error {
+	resp, err := c.http.Get(c.config.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if c.config.Status != 0 && resp.StatusCode != c.config.Status {
+		return fmt.Errorf("%s status %d, expect %d", c.config.URL, resp.StatusCode, c.config.Status)
+	}
+	if c.config.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("%s status %d", c.config.URL, resp.StatusCode)
+	}
+	if c.body == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return err
+	}
+	if !c.body.Match(body) {
+		return fmt.Errorf("%s body does not match %s", c.config.URL, c.config.Body)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckRiseFall(t *testing.T) {
+	config := CheckConfig{Type: "exec", Command: "true"}
+	config.setDefaults("127.0.0.1", 80, 10)
+	c := newCheck(config)
+	if changed, err := c.Update(); !changed || err != nil || !c.Healthy() {
+		t.Fatalf("first pass = %v, %v, healthy %v", changed, err, c.Healthy())
+	}
+	c.config.Command = "false"
+	for i := 1; i < config.Fall; i++ {
+		if changed, _ := c.Update(); changed || !c.Healthy() {
+			t.Fatalf("failure %d turned unhealthy before fall %d", i, config.Fall)
+		}
+	}
+	if changed, err := c.Update(); !changed || err == nil || c.Healthy() {
+		t.Fatalf("failure %d = %v, %v, healthy %v", config.Fall, changed, err, c.Healthy())
+	}
+	c.config.Command = "true"
+	for i := 1; i < config.Rise; i++ {
+		if changed, _ := c.Update(); changed || c.Healthy() {
+			t.Fatalf("pass %d turned healthy before rise %d", i, config.Rise)
+		}
+	}
+	if changed, _ := c.Update(); !changed || !c.Healthy() {
+		t.Fatalf("pass %d not healthy", config.Rise)
+	}
+}
+
+func TestCheckProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+	for _, test := range []struct {
+		config CheckConfig
+		pass   bool
+	}{
+		{CheckConfig{Type: "tcp", Address: address}, true},
+		{CheckConfig{Type: "http", URL: server.URL + "/health"}, true},
+		{CheckConfig{Type: "http", URL: server.URL + "/down"}, false},
+		{CheckConfig{Type: "http", URL: server.URL + "/down", Status: 503}, true},
+		{CheckConfig{Type: "http", URL: server.URL + "/health", Body: `"status":\s*"ok"`}, true},
+		{CheckConfig{Type: "http", URL: server.URL + "/health", Body: "fail"}, false},
+		{CheckConfig{Type: "exec", Command: "exit 2"}, false},
+	} {
+		test.config.setDefaults("127.0.0.1", 1, 10)
+		if err := test.config.validate(); err != nil {
+			t.Fatal(err)
+		}
+		err := newCheck(test.config).probe()
+		if (err == nil) != test.pass {
+			t.Errorf("probe %+v = %v, expect pass %v", test.config, err, test.pass)
+		}
+	}
+}
+
+func TestCheckExecTimeout(t *testing.T) {
+	config := CheckConfig{Type: "exec", Command: "sleep 5; true", Timeout: 100}
+	config.setDefaults("127.0.0.1", 80, 10)
+	start := time.Now()
+	if err := newCheck(config).probe(); err == nil {
+		t.Errorf("probe of a hung command expect error")
+	}
+	//the sleep child keeps the output open after the shell is killed
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("probe returned after %s", elapsed)
+	}
+}
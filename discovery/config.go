@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxHosts bound the addresses one scanner expands from its host list
+const maxHosts = 65536
+
+// Config of one scanner, from a [[discovery]] table of topod.toml
+type Config struct {
+	Name        string   `toml:"name"`
+	Hosts       []string `toml:"hosts"`
+	Ports       []string `toml:"ports"`
+	Probe       string   `toml:"probe"`
+	HttpPath    string   `toml:"http_path"`
+	Interval    int      `toml:"interval"`
+	Timeout     int      `toml:"timeout_ms"`
+	Concurrency int      `toml:"concurrency"`
+	Prefix      string   `toml:"prefix"`
+	Owner       string   `toml:"owner"`
+	Misses      int      `toml:"misses"`
+}
+
+func (c *Config) setDefaults() {
+	if c.Probe == "" {
+		c.Probe = "tcp"
+	}
+	if c.HttpPath == "" {
+		c.HttpPath = "/"
+	}
+	if c.Interval <= 0 {
+		c.Interval = 60
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 1000
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 32
+	}
+	if c.Owner == "" {
+		c.Owner, _ = os.Hostname()
+	}
+	if c.Misses <= 0 {
+		c.Misses = 3
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Name == "" {
+		return errors.New("discovery name required")
+	}
+	if c.Prefix == "" {
+		return fmt.Errorf("discovery %s prefix required", c.Name)
+	}
+	if c.Owner == "" {
+		return fmt.Errorf("discovery %s owner required, host name unknown", c.Name)
+	}
+	if c.Probe != "tcp" && c.Probe != "http" {
+		return fmt.Errorf("discovery %s unknown probe %s, tcp or http", c.Name, c.Probe)
+	}
+	return nil
+}
+
+// expandHosts turn ip addresses, host names and cidrs into a host list
+func expandHosts(hosts []string) ([]string, error) {
+	result := make([]string, 0)
+	for _, h := range hosts {
+		if !strings.Contains(h, "/") {
+			result = append(result, h)
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(h)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("cidr %s too large, at most %d hosts", h, maxHosts)
+		}
+		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); ip = nextIP(ip) {
+			result = append(result, ip.String())
+		}
+		if len(result) > maxHosts {
+			return nil, fmt.Errorf("too many hosts, at most %d", maxHosts)
+		}
+	}
+	return result, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// expandPorts turn ports and ranges like 8000-8010 into a port list
+func expandPorts(ports []string) ([]int, error) {
+	result := make([]int, 0)
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("bad port %s", p)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("bad port range %s", p)
+			}
+		}
+		if from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("bad port range %s", p)
+		}
+		for port := from; port <= to; port++ {
+			result = append(result, port)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,238 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store"
+)
+
+// Service is the record a registrar publishes under prefix/name/id
+type Service struct {
+	Name     string          `json:"name"`
+	ID       string          `json:"id"`
+	Address  string          `json:"address"`
+	Port     int             `json:"port"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	Healthy  bool            `json:"healthy"`
+}
+
+// RegisterConfig of one published service, from a [[register]] table of topod.toml
+type RegisterConfig struct {
+	Name      string `toml:"name"`
+	ID        string `toml:"id"`
+	Address   string `toml:"address"`
+	Port      int    `toml:"port"`
+	Metadata  string `toml:"metadata"`
+	Prefix    string `toml:"prefix"`
+	TTL       int    `toml:"ttl"`
+	Heartbeat int    `toml:"heartbeat"`
+	//no health check when nil, the service is always healthy
+	Check *CheckConfig `toml:"check"`
+}
+
+func (c *RegisterConfig) setDefaults() error {
+	if c.Prefix == "" {
+		c.Prefix = "/services"
+	}
+	if c.TTL <= 0 {
+		c.TTL = 30
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = c.TTL / 3
+		if c.Heartbeat == 0 {
+			c.Heartbeat = 1
+		}
+	}
+	if c.Address == "" {
+		address, err := localAddress()
+		if err != nil {
+			return err
+		}
+		c.Address = address
+	}
+	if c.ID == "" {
+		c.ID = net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
+	}
+	if c.Check != nil {
+		c.Check.setDefaults(c.Address, c.Port, c.Heartbeat)
+	}
+	return nil
+}
+
+func (c *RegisterConfig) validate() error {
+	if c.Name == "" || strings.Contains(c.Name, "/") {
+		return fmt.Errorf("invalid service name %q", c.Name)
+	}
+	if strings.Contains(c.ID, "/") {
+		return fmt.Errorf("service %s invalid id %q", c.Name, c.ID)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("service %s invalid port %d", c.Name, c.Port)
+	}
+	if c.Heartbeat >= c.TTL {
+		return fmt.Errorf("service %s heartbeat %ds must be less than ttl %ds", c.Name, c.Heartbeat, c.TTL)
+	}
+	if c.Metadata != "" && !json.Valid([]byte(c.Metadata)) {
+		return fmt.Errorf("service %s metadata is not valid json", c.Name)
+	}
+	if c.Check != nil {
+		if err := c.Check.validate(); err != nil {
+			return fmt.Errorf("service %s %s", c.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// localAddress return the first non loopback ipv4 address of the host
+func localAddress() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("no service address found, set address")
+}
+
+/*
+* Registrar publish a service record under prefix/name/id with a ttl and write it
+* again every heartbeat, so the record disappears when topod dies without deregistering.
+* With a health check the record is withdrawn while the service is unhealthy, or kept
+* with healthy false when the check marks instead.
+ */
+type Registrar struct {
+	config  RegisterConfig
+	key     string
+	service Service
+	check   *Check
+	client  store.StoreClient
+	ttl     store.TTLStoreClient
+}
+
+/*
+* NewRegistrar create registrar, prefix is the global key prefix the service prefix is joined to.
+* Stores without ttl are refused, a record they keep would outlive a dead topod.
+ */
+func NewRegistrar(config RegisterConfig, prefix string, client store.StoreClient) (*Registrar, error) {
+	if err := config.setDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	ttl, ok := client.(store.TTLStoreClient)
+	if !ok {
+		return nil, fmt.Errorf("register %s: store has no ttl support", config.Name)
+	}
+	r := &Registrar{
+		config:  config,
+		key:     path.Join("/", prefix, config.Prefix, config.Name, config.ID),
+		service: Service{Name: config.Name, ID: config.ID, Address: config.Address, Port: config.Port, Healthy: true},
+		client:  client,
+		ttl:     ttl,
+	}
+	if config.Metadata != "" {
+		r.service.Metadata = json.RawMessage(config.Metadata)
+	}
+	if config.Check != nil {
+		r.check = newCheck(*config.Check)
+	}
+	return r, nil
+}
+
+// Key return the store key of the service record
+func (r *Registrar) Key() string {
+	return r.key
+}
+
+// Register write the service record with ttl
+func (r *Registrar) Register() error {
+	data, err := json.Marshal(r.service)
+	if err != nil {
+		return err
+	}
+	if _, err = r.ttl.SetTTL(r.key, string(data), time.Duration(r.config.TTL)*time.Second); err != nil {
+		return fmt.Errorf("register %s: %s", r.key, err.Error())
+	}
+	return nil
+}
+
+// Deregister remove the service record
+func (r *Registrar) Deregister() error {
+	if err := r.client.Delete(r.key); err != nil && err != store.ErrKeyNotFound {
+		return fmt.Errorf("deregister %s: %s", r.key, err.Error())
+	}
+	return nil
+}
+
+// publish write the record of a healthy or marked service and withdraw an unhealthy one
+func (r *Registrar) publish() error {
+	if r.service.Healthy || (r.check != nil && r.config.Check.Mark) {
+		return r.Register()
+	}
+	return r.Deregister()
+}
+
+// updateCheck probe the service and return whether its health changed
+func (r *Registrar) updateCheck() bool {
+	changed, err := r.check.Update()
+	if err != nil {
+		logger.Log.Debug("Service %s check failed: %s", r.key, err.Error())
+	}
+	if !changed {
+		return false
+	}
+	r.service.Healthy = r.check.Healthy()
+	if r.service.Healthy {
+		logger.Log.Notice("Service %s is healthy", r.key)
+	} else {
+		logger.Log.Warning("Service %s is unhealthy", r.key)
+	}
+	return true
+}
+
+// Run register and heartbeat until stopChan closed, then deregister and return
+func (r *Registrar) Run(stopChan chan bool, errChan chan error) {
+	logger.Log.Info("Register service %s", r.key)
+	heartbeat := time.NewTicker(time.Duration(r.config.Heartbeat) * time.Second)
+	defer heartbeat.Stop()
+	var checks <-chan time.Time
+	if r.check != nil {
+		ticker := time.NewTicker(time.Duration(r.config.Check.Interval) * time.Second)
+		defer ticker.Stop()
+		checks = ticker.C
+		r.updateCheck()
+	}
+	if err := r.publish(); err != nil {
+		errChan <- err
+	}
+	for {
+		select {
+		case <-stopChan:
+			logger.Log.Info("Deregister service %s", r.key)
+			if err := r.Deregister(); err != nil {
+				logger.Log.Error(err.Error())
+			}
+			return
+		case <-heartbeat.C:
+		case <-checks:
+			if !r.updateCheck() {
+				continue
+			}
+		}
+		if err := r.publish(); err != nil {
+			errChan <- err
+		}
+	}
+}
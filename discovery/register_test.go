@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/internal/storetest"
+	"github.com/leightonwong/topod/store"
+)
+
+// plainStore hide SetTTL of the test store
+type plainStore struct {
+	store.StoreClient
+}
+
+func TestNewRegistrarNoTTL(t *testing.T) {
+	if _, err := NewRegistrar(RegisterConfig{Name: "web", Address: "10.0.0.3", Port: 8080}, "/", plainStore{storetest.NewClient(nil)}); err == nil {
+		t.Errorf("NewRegistrar with a store without ttl expect error")
+	}
+}
+
+func TestRegistrar(t *testing.T) {
+	st := storetest.NewClient(nil)
+	r, err := NewRegistrar(RegisterConfig{
+		Name:     "web",
+		Address:  "10.0.0.3",
+		Port:     8080,
+		Metadata: `{"weight":10}`,
+		TTL:      2,
+	}, "/app", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Key() != "/app/services/web/10.0.0.3:8080" {
+		t.Errorf("key = %s", r.Key())
+	}
+	if err := r.Register(); err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := st.Get(r.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var service Service
+	if err := json.Unmarshal([]byte(value), &service); err != nil {
+		t.Fatal(err)
+	}
+	expect := Service{Name: "web", ID: "10.0.0.3:8080", Address: "10.0.0.3", Port: 8080, Metadata: json.RawMessage(`{"weight":10}`), Healthy: true}
+	if !reflect.DeepEqual(service, expect) {
+		t.Errorf("service = %+v, expect %+v", service, expect)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	if _, _, err := st.Get(r.Key()); err != store.ErrKeyNotFound {
+		t.Errorf("record not expired after ttl, err %v", err)
+	}
+}
+
+func TestRegistrarRun(t *testing.T) {
+	st := storetest.NewClient(nil)
+	r, err := NewRegistrar(RegisterConfig{Name: "web", Address: "10.0.0.3", Port: 8080}, "/", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	go func() {
+		r.Run(stopChan, make(chan error, 1))
+		close(doneChan)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := st.Get(r.Key()); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopChan)
+	select {
+	case <-doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registrar not stopped")
+	}
+	if _, _, err := st.Get(r.Key()); err != store.ErrKeyNotFound {
+		t.Errorf("service not deregistered on stop, err %v", err)
+	}
+}
+
+func TestNewRegistrarInvalid(t *testing.T) {
+	for _, c := range []RegisterConfig{
+		{Address: "10.0.0.3", Port: 80},
+		{Name: "a/b", Address: "10.0.0.3", Port: 80},
+		{Name: "web", Address: "10.0.0.3"},
+		{Name: "web", Address: "10.0.0.3", Port: 80, Metadata: "{"},
+		{Name: "web", Address: "10.0.0.3", Port: 80, TTL: 10, Heartbeat: 10},
+	} {
+		if _, err := NewRegistrar(c, "/", storetest.NewClient(nil)); err == nil {
+			t.Errorf("NewRegistrar(%+v) expect error", c)
+		}
+	}
+}
+
+func TestRegistrarCheck(t *testing.T) {
+	st := storetest.NewClient(nil)
+	r, err := NewRegistrar(RegisterConfig{
+		Name:    "web",
+		Address: "10.0.0.3",
+		Port:    8080,
+		Check:   &CheckConfig{Type: "exec", Command: "exit 1", Mark: true},
+	}, "/", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.updateCheck()
+	if err := r.publish(); err != nil {
+		t.Fatal(err)
+	}
+	value, _, err := st.Get(r.Key())
+	if err != nil {
+		t.Fatalf("marked service not registered: %v", err)
+	}
+	var service Service
+	json.Unmarshal([]byte(value), &service)
+	if service.Healthy {
+		t.Errorf("failing service marked healthy")
+	}
+
+	r.config.Check.Mark = false
+	if err := r.publish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.Get(r.Key()); err != store.ErrKeyNotFound {
+		t.Errorf("unhealthy service not withdrawn, err %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store"
+)
+
+// Endpoint is the value written for every discovered host:port
+type Endpoint struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Probe   string `json:"probe"`
+	Owner   string `json:"owner"`
+}
+
+/*
+* Scanner probe every host and port of its config each interval and keep the store
+* in sync: reachable endpoints are written to prefix/host:port with the scanner owner,
+* endpoints of this owner missed by Misses scans in a row are deleted. Endpoints of other
+* owners are left alone, so scanners on several hosts can share a prefix. Unchanged
+* endpoints are not written again, so watches only fire on real changes.
+ */
+type Scanner struct {
+	config Config
+	prefix string
+	client store.StoreClient
+	hosts  []string
+	ports  []int
+	http   *http.Client
+	//consecutive scans which missed each owned endpoint
+	misses map[string]int
+}
+
+// NewScanner create scanner, prefix is the global key prefix the scanner prefix is joined to
+func NewScanner(config Config, prefix string, client store.StoreClient) (*Scanner, error) {
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	hosts, err := expandHosts(config.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := expandPorts(config.Ports)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	return &Scanner{
+		config: config,
+		prefix: path.Join("/", prefix, config.Prefix),
+		client: client,
+		hosts:  hosts,
+		ports:  ports,
+		misses: make(map[string]int),
+		http: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Run scan until stopChan closed, store errors are sent to errChan
+func (s *Scanner) Run(stopChan chan bool, errChan chan error) {
+	for {
+		if err := s.Scan(); err != nil {
+			errChan <- err
+		}
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(time.Duration(s.config.Interval) * time.Second):
+		}
+	}
+}
+
+// Scan probe all endpoints once and sync the result to the store
+func (s *Scanner) Scan() error {
+	found := s.probeAll()
+	logger.Log.Debug("Discovery %s found %d endpoints", s.config.Name, len(found))
+	current, err := s.client.GetValues([]string{s.prefix})
+	if err != nil {
+		return fmt.Errorf("discovery %s: %s", s.config.Name, err.Error())
+	}
+	misses := make(map[string]int)
+	for key, e := range found {
+		//an endpoint already published, by this scanner or another one, is kept as is
+		if old, ok := parseEndpoint(current[key]); ok {
+			old.Owner = e.Owner
+			if old == e {
+				continue
+			}
+		}
+		logger.Log.Info("Discovery %s found endpoint %s", s.config.Name, path.Base(key))
+		value, _ := json.Marshal(e)
+		if _, err := s.client.Set(key, string(value)); err != nil {
+			return fmt.Errorf("discovery %s set %s: %s", s.config.Name, key, err.Error())
+		}
+	}
+	for key, value := range current {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		if e, ok := parseEndpoint(value); !ok || e.Owner != s.config.Owner {
+			continue
+		}
+		if misses[key] = s.misses[key] + 1; misses[key] < s.config.Misses {
+			logger.Log.Debug("Discovery %s missed endpoint %s %d times", s.config.Name, path.Base(key), misses[key])
+			continue
+		}
+		logger.Log.Info("Discovery %s lost endpoint %s", s.config.Name, path.Base(key))
+		if err := s.client.Delete(key); err != nil && err != store.ErrKeyNotFound {
+			return fmt.Errorf("discovery %s delete %s: %s", s.config.Name, key, err.Error())
+		}
+		delete(misses, key)
+	}
+	s.misses = misses
+	return nil
+}
+
+func parseEndpoint(value string) (Endpoint, bool) {
+	var e Endpoint
+	if value == "" || json.Unmarshal([]byte(value), &e) != nil {
+		return e, false
+	}
+	return e, true
+}
+
+func (s *Scanner) probeAll() map[string]Endpoint {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	found := make(map[string]Endpoint)
+	targets := make(chan Endpoint)
+	for i := 0; i < s.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range targets {
+				if !s.probe(e.Address, e.Port) {
+					continue
+				}
+				lock.Lock()
+				found[path.Join(s.prefix, net.JoinHostPort(e.Address, strconv.Itoa(e.Port)))] = e
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, host := range s.hosts {
+		for _, port := range s.ports {
+			targets <- Endpoint{Name: s.config.Name, Address: host, Port: port, Probe: s.config.Probe, Owner: s.config.Owner}
+		}
+	}
+	close(targets)
+	wg.Wait()
+	return found
+}
+
+func (s *Scanner) probe(host string, port int) bool {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if s.config.Probe == "http" {
+		resp, err := s.http.Get("http://" + address + s.config.HttpPath)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 400
+	}
+	conn, err := net.DialTimeout("tcp", address, time.Duration(s.config.Timeout)*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leightonwong/topod/internal/storetest"
+	"github.com/leightonwong/topod/store"
+)
+
+func TestExpand(t *testing.T) {
+	hosts, err := expandHosts([]string{"10.0.0.254/31", "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"10.0.0.254", "10.0.0.255", "example.com"}; !reflect.DeepEqual(hosts, expect) {
+		t.Errorf("expandHosts = %v, expect %v", hosts, expect)
+	}
+	if _, err := expandHosts([]string{"10.0.0.0/8"}); err == nil {
+		t.Errorf("expandHosts /8 expect error")
+	}
+	ports, err := expandPorts([]string{"80", "8000-8002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []int{80, 8000, 8001, 8002}; !reflect.DeepEqual(ports, expect) {
+		t.Errorf("expandPorts = %v, expect %v", ports, expect)
+	}
+	for _, bad := range []string{"x", "0", "9-8", "1-70000"} {
+		if _, err := expandPorts([]string{bad}); err == nil {
+			t.Errorf("expandPorts(%s) expect error", bad)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	okPort := port(t, ok.Listener)
+	failingPort := port(t, failing.Listener)
+
+	other := `{"name":"web","address":"10.0.0.1","port":80,"probe":"http","owner":"host-b"}`
+	st := storetest.NewClient(map[string]string{
+		"/app/services/web/10.0.0.1:80": other,
+		"/app/services/web/10.0.0.2:80": "not an endpoint",
+	})
+	s, err := NewScanner(Config{
+		Name:   "web",
+		Hosts:  []string{"127.0.0.1/32"},
+		Ports:  []string{okPort, failingPort},
+		Probe:  "http",
+		Prefix: "/services/web",
+		Owner:  "host-a",
+		Misses: 2,
+	}, "/app", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	okKey := "/app/services/web/127.0.0.1:" + okPort
+	values, _ := st.GetValues([]string{"/app/services/web"})
+	expect := map[string]string{
+		"/app/services/web/10.0.0.1:80": other,
+		"/app/services/web/10.0.0.2:80": "not an endpoint",
+		okKey:                           `{"name":"web","address":"127.0.0.1","port":` + okPort + `,"probe":"http","owner":"host-a"}`,
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("http scan = %v, expect %v, keys of other owners kept", values, expect)
+	}
+
+	//unchanged endpoints are not written again, nor endpoints already published by another owner
+	_, index, _ := st.Get(okKey)
+	s.Scan()
+	if _, again, _ := st.Get(okKey); again != index {
+		t.Errorf("unchanged endpoint rewritten, index %d to %d", index, again)
+	}
+	other = strings.Replace(expect[okKey], "host-a", "host-b", 1)
+	index, _ = st.Set(okKey, other)
+	s.Scan()
+	if v, again, _ := st.Get(okKey); again != index || v != other {
+		t.Errorf("endpoint of host-b rewritten to %s, index %d to %d", v, index, again)
+	}
+	st.Set(okKey, expect[okKey])
+
+	//a lost endpoint is deleted after misses scans in a row
+	ok.Close()
+	if err := s.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.Get(okKey); err != nil {
+		t.Errorf("endpoint deleted after one miss, err %v", err)
+	}
+	if err := s.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.Get(okKey); err != store.ErrKeyNotFound {
+		t.Errorf("lost endpoint not deleted after two misses, err %v", err)
+	}
+	if values, _ := st.GetValues([]string{"/app/services/web"}); len(values) != 2 {
+		t.Errorf("keys of other owners deleted, left %v", values)
+	}
+}
+
+func TestNewScannerInvalid(t *testing.T) {
+	for _, c := range []Config{
+		{Prefix: "/services"},
+		{Name: "web"},
+		{Name: "web", Prefix: "/services", Probe: "udp"},
+		{Name: "web", Prefix: "/services", Ports: []string{"http"}},
+	} {
+		if _, err := NewScanner(c, "/", storetest.NewClient(nil)); err == nil {
+			t.Errorf("NewScanner(%+v) expect error", c)
+		}
+	}
+}
+
+func port(t *testing.T, l net.Listener) string {
+	_, p, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strconv.Atoi(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
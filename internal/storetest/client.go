@@ -0,0 +1,188 @@
+// Package storetest is an in-process StoreClient backing the tests of packages using a store,
+// it needs no external service.
+package storetest
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// Client keep keys in a map, the index grows by one on every write
+type Client struct {
+	lock     sync.RWMutex
+	values   map[string]string
+	modified map[string]uint64
+	index    uint64
+	changed  chan struct{}
+	expires  map[string]*time.Timer
+}
+
+func NewClient(values map[string]string) *Client {
+	c := &Client{
+		values:   make(map[string]string),
+		modified: make(map[string]uint64),
+		changed:  make(chan struct{}),
+		expires:  make(map[string]*time.Timer),
+		//an empty store is at index 1, a zero index asks WatchPrefix for the current one
+		index: 1,
+	}
+	for k, v := range values {
+		c.Set(k, v)
+	}
+	return c
+}
+
+func under(key, prefix string) bool {
+	return key == prefix || prefix == "/" || strings.HasPrefix(key, prefix+"/")
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	values := make(map[string]string)
+	for _, key := range keys {
+		key = path.Join("/", key)
+		for k, v := range c.values {
+			if under(k, key) {
+				values[k] = v
+			}
+		}
+	}
+	return values, nil
+}
+
+// WatchPrefix block until a key under prefix is written or deleted after waitIndex
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	index, _, err := c.WatchPrefixKeys(prefix, waitIndex, stopChan)
+	return index, err
+}
+
+// WatchPrefixKeys is WatchPrefix returning the keys under prefix modified after waitIndex, sorted
+func (c *Client) WatchPrefixKeys(prefix string, waitIndex uint64, stopChan chan bool) (uint64, []string, error) {
+	prefix = path.Join("/", prefix)
+	for {
+		c.lock.RLock()
+		if waitIndex == 0 {
+			index := c.index
+			c.lock.RUnlock()
+			return index, nil, nil
+		}
+		var index uint64
+		var keys []string
+		for k, i := range c.modified {
+			if i > waitIndex && under(k, prefix) {
+				keys = append(keys, k)
+				if i > index {
+					index = i
+				}
+			}
+		}
+		changed := c.changed
+		c.lock.RUnlock()
+		if index > 0 {
+			sort.Strings(keys)
+			return index, keys, nil
+		}
+		select {
+		case <-stopChan:
+			return waitIndex, nil, errors.New("test store watch stopped")
+		case <-changed:
+		}
+	}
+}
+
+func (c *Client) Get(key string) (string, uint64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	key = path.Join("/", key)
+	v, ok := c.values[key]
+	if !ok {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return v, c.modified[key], nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key = path.Join("/", key)
+	c.values[key] = value
+	return c.touch(key), nil
+}
+
+// SetTTL set key and remove it after ttl unless it is written again
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key = path.Join("/", key)
+	c.values[key] = value
+	index := c.touch(key)
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.expires[key] == timer {
+			delete(c.values, key)
+			c.touch(key)
+		}
+	})
+	c.expires[key] = timer
+	return index, nil
+}
+
+func (c *Client) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key = path.Join("/", key)
+	if _, ok := c.values[key]; !ok {
+		return storeerr.ErrKeyNotFound
+	}
+	delete(c.values, key)
+	c.touch(key)
+	return nil
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prefix = path.Join("/", prefix)
+	for k := range c.values {
+		if under(k, prefix) {
+			delete(c.values, k)
+			c.touch(k)
+		}
+	}
+	return nil
+}
+
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key = path.Join("/", key)
+	_, exists := c.values[key]
+	if exists != (prevIndex != 0) || (exists && c.modified[key] != prevIndex) {
+		return 0, storeerr.ErrCompareFailed
+	}
+	c.values[key] = value
+	return c.touch(key), nil
+}
+
+// touch record a change of key, drop its expire and wake up watchers, lock must be held
+func (c *Client) touch(key string) uint64 {
+	if timer, ok := c.expires[key]; ok {
+		timer.Stop()
+		delete(c.expires, key)
+	}
+	c.index++
+	c.modified[key] = c.index
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.index
+}
@@ -0,0 +1,63 @@
+package storetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+func TestWatchPrefixKeys(t *testing.T) {
+	c := NewClient(map[string]string{"/app/port": "80", "/db/host": "10.0.0.1"})
+	stopChan := make(chan bool)
+	index, keys, err := c.WatchPrefixKeys("/app", 0, stopChan)
+	if err != nil || index == 0 || keys != nil {
+		t.Fatalf("WatchPrefixKeys current = %d, %v, %v", index, keys, err)
+	}
+	go func() {
+		c.Set("/db/host", "10.0.0.2")
+		c.Set("/app/port", "8080")
+		c.Set("/app/name", "web")
+	}()
+	deadline := time.Now().Add(time.Second)
+	var changed []string
+	for len(changed) < 2 && time.Now().Before(deadline) {
+		index, keys, err = c.WatchPrefixKeys("/app", index, stopChan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed = append(changed, keys...)
+	}
+	if !reflect.DeepEqual(changed, []string{"/app/port", "/app/name"}) && !reflect.DeepEqual(changed, []string{"/app/name", "/app/port"}) {
+		t.Errorf("changed keys = %v, expect /app/port and /app/name", changed)
+	}
+
+	close(stopChan)
+	if _, _, err := c.WatchPrefixKeys("/app", index, stopChan); err == nil {
+		t.Errorf("stopped watch expect error")
+	}
+}
+
+func TestCompareAndSwapAndTTL(t *testing.T) {
+	c := NewClient(nil)
+	index, err := c.CompareAndSwap("/lock", "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CompareAndSwap("/lock", "b", 0); err != storeerr.ErrCompareFailed {
+		t.Errorf("create of existing key error = %v, expect compare failed", err)
+	}
+	if _, err := c.CompareAndSwap("/lock", "b", index); err != nil {
+		t.Errorf("swap at current index error = %v", err)
+	}
+
+	c.SetTTL("/service", "up", 20*time.Millisecond)
+	if v, _, err := c.Get("/service"); err != nil || v != "up" {
+		t.Fatalf("Get before ttl = %q, %v", v, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, _, err := c.Get("/service"); err != storeerr.ErrKeyNotFound {
+		t.Errorf("Get after ttl error = %v, expect not found", err)
+	}
+}
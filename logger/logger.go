@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/op/go-logging"
@@ -16,6 +17,11 @@ func init() {
 	//logging.SetLevel(logging.DEBUG, "topod")
 }
 
+// SetOutput redirect log to w, command line verbs log to stderr to keep stdout for their output
+func SetOutput(w io.Writer) {
+	logging.SetBackend(logging.NewLogBackend(w, "", 0))
+}
+
 func SetLevel(isDebug, isVerbose bool) {
 	if isDebug {
 		logging.SetLevel(logging.DEBUG, "topod")
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/leightonwong/topod/discovery"
+	"github.com/leightonwong/topod/logger"
+	storage "github.com/leightonwong/topod/store"
+)
+
+/*
+* Start a registrar for every service, they heartbeat until stopChan is closed.
+* The returned WaitGroup is done once every service has been deregistered.
+ */
+func startRegistrars(client storage.StoreClient, services []discovery.RegisterConfig, stopChan chan bool, errChan chan error) (*sync.WaitGroup, error) {
+	registrars := make([]*discovery.Registrar, len(services))
+	for i, service := range services {
+		r, err := discovery.NewRegistrar(service, config.Prefix, client)
+		if err != nil {
+			return nil, err
+		}
+		registrars[i] = r
+	}
+	var wg sync.WaitGroup
+	for _, r := range registrars {
+		wg.Add(1)
+		go func(r *discovery.Registrar) {
+			defer wg.Done()
+			r.Run(stopChan, errChan)
+		}(r)
+	}
+	return &wg, nil
+}
+
+// runRegister publish the service given on the command line, or the [[register]] services of the config file, until interrupted
+func runRegister(client storage.StoreClient) error {
+	services := config.Register
+	if options.Register.Name != "" {
+		services = []discovery.RegisterConfig{{
+			Name:      options.Register.Name,
+			ID:        options.Register.ID,
+			Address:   options.Register.Address,
+			Port:      options.Register.Port,
+			Metadata:  options.Register.Metadata,
+			Prefix:    options.Register.Prefix,
+			TTL:       options.Register.TTL,
+			Heartbeat: options.Register.Heartbeat,
+		}}
+		if options.Register.Check != "" {
+			services[0].Check = &discovery.CheckConfig{
+				Type:    options.Register.Check,
+				URL:     options.Register.CheckURL,
+				Body:    options.Register.CheckBody,
+				Command: options.Register.CheckCmd,
+			}
+		}
+	}
+	if len(services) == 0 {
+		return errors.New("register: service name required, set --name or [[register]] in config file")
+	}
+	stopChan := make(chan bool)
+	errChan := make(chan error, 10)
+	wg, err := startRegistrars(client, services, stopChan, errChan)
+	if err != nil {
+		return err
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case err := <-errChan:
+			logger.Log.Error(err.Error())
+		case s := <-signalChan:
+			logger.Log.Info("captured %v deregistering...", s)
+			close(stopChan)
+			wg.Wait()
+			return nil
+		}
+	}
+}
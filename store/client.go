@@ -2,17 +2,66 @@ package store
 
 import (
 	"errors"
+	"time"
 
 	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store/consul"
+	"github.com/leightonwong/topod/store/env"
 	"github.com/leightonwong/topod/store/etcd"
+	"github.com/leightonwong/topod/store/etcdv3"
+	"github.com/leightonwong/topod/store/file"
+	"github.com/leightonwong/topod/store/redis"
+	"github.com/leightonwong/topod/store/storeerr"
+	"github.com/leightonwong/topod/store/vault"
+	"github.com/leightonwong/topod/store/zookeeper"
 )
 
+var (
+	ErrKeyNotFound   = storeerr.ErrKeyNotFound
+	ErrCompareFailed = storeerr.ErrCompareFailed
+	ErrNotSupported  = storeerr.ErrNotSupported
+)
+
+/*
+* StoreClient read, watch and modify keys of the central configuration store.
+* Index returned by Get, Set and CompareAndSwap is the modified index of the key,
+* CompareAndSwap only writes when the key is still at prevIndex, prevIndex 0 means the
+* key must not exist. ErrCompareFailed is returned when the guard does not match.
+* Read only stores return ErrNotSupported on write.
+ */
 type StoreClient interface {
 	GetValues(keys []string) (map[string]string, error)
 	WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error)
+	Get(key string) (string, uint64, error)
+	Set(key, value string) (uint64, error)
+	Delete(key string) error
+	DeleteTree(prefix string) error
+	CompareAndSwap(key, value string, prevIndex uint64) (uint64, error)
+}
+
+// TTLStoreClient is implemented by stores able to expire keys, a key written by SetTTL
+// is removed by the store unless written again within ttl.
+type TTLStoreClient interface {
+	SetTTL(key, value string, ttl time.Duration) (uint64, error)
+}
+
+// KeyWatchClient is implemented by stores able to tell which keys changed, WatchPrefixKeys
+// is WatchPrefix also returning the keys under prefix modified after waitIndex. Keys are
+// nil when they are not known, like for the current index asked by a zero waitIndex.
+type KeyWatchClient interface {
+	WatchPrefixKeys(prefix string, waitIndex uint64, stopChan chan bool) (uint64, []string, error)
 }
 
 func NewClient(config Config) (StoreClient, error) {
+	client, err := newClient(config)
+	if err != nil {
+		//constructors return a nil pointer on error, do not hand it out as a non nil StoreClient
+		return nil, err
+	}
+	return client, nil
+}
+
+func newClient(config Config) (StoreClient, error) {
 	if config.Store == "" {
 		config.Store = "etcd"
 	}
@@ -21,6 +70,22 @@ func NewClient(config Config) (StoreClient, error) {
 	switch config.Store {
 	case "etcd":
 		return etcd.NewClient(storeNodes, config.Cert, config.Key, config.CaKeys)
+	case "etcdv3":
+		return etcdv3.NewClient(storeNodes, config.Schema, config.Cert, config.Key, config.CaKeys, config.Gateway)
+	case "consul", "consule":
+		return consul.NewClient(storeNodes, config.Schema, config.Cert, config.Key, config.CaKeys, config.Token)
+	case "file":
+		//store nodes are local yaml, json or toml file paths
+		return file.NewClient(storeNodes)
+	case "env":
+		return env.NewClient()
+	case "redis":
+		return redis.NewClient(storeNodes, config.Password, config.DB)
+	case "zookeeper":
+		return zookeeper.NewClient(storeNodes, config.Token)
+	case "vault":
+		return vault.NewClient(storeNodes, config.Schema, config.Cert, config.Key, config.CaKeys,
+			config.AuthType, config.Token, config.RoleID, config.SecretID, config.KVVersion)
 	}
 	return nil, errors.New("Invalid store config")
 }
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestNewClientError(t *testing.T) {
+	for _, config := range []Config{
+		{Store: "file", Nodes: []string{"/missing/topod.yaml"}},
+		{Store: "consul"},
+		{Store: "etcdv3"},
+		{Store: "vault"},
+		{Store: "nowhere"},
+	} {
+		client, err := NewClient(config)
+		if err == nil {
+			t.Errorf("%s store expect error", config.Store)
+		}
+		if client != nil {
+			t.Errorf("%s store client = %#v on error, expect nil", config.Store, client)
+		}
+	}
+}
@@ -7,4 +7,16 @@ type Config struct {
 	Key    string
 	Cert   string
 	CaKeys string
+	//consul acl token, vault token or zookeeper digest user:password
+	Token string
+	//redis password and db number
+	Password string
+	DB       int
+	//vault auth type token, approle or cert, and kv engine version, 0 to detect
+	AuthType  string
+	RoleID    string
+	SecretID  string
+	KVVersion int
+	//etcd v3 json gateway path, /v3, /v3beta or /v3alpha
+	Gateway string
 }
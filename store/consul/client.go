@@ -0,0 +1,459 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// Blocking query max wait time, consul caps it at 10 minutes and adds up to wait/16 of jitter
+const watchWait = 5 * time.Minute
+
+// requestTimeout bound a request to one node, blocking queries get it on top of their wait
+const requestTimeout = 10 * time.Second
+
+// consul refuses session ttls out of [10s, 24h]
+const (
+	minSessionTTL = 10 * time.Second
+	maxSessionTTL = 24 * time.Hour
+)
+
+type Client struct {
+	client  *http.Client
+	nodes   []string
+	token   string
+	timeout time.Duration
+	lock    sync.Mutex
+	//sessions holding keys written by SetTTL
+	sessions map[string]string
+}
+
+type kvPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+/*
+*	New consul KV client from nodes list host:port, return *consul.Client
+*	Use https when schema is https or client cert is given
+ */
+func NewClient(nodes []string, schema, cert, key, caCert, token string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("empty consul nodes")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if schema == "" {
+		schema = "http"
+	}
+	if (cert != "" && key != "") || caCert != "" {
+		schema = "https"
+		tlsConfig := &tls.Config{}
+		if cert != "" && key != "" {
+			certificate, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		if caCert != "" {
+			ca, err := ioutil.ReadFile(caCert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.New("invalid consul ca cert " + caCert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	machines := make([]string, len(nodes))
+	for i, node := range nodes {
+		if strings.Contains(node, "://") {
+			machines[i] = strings.TrimRight(node, "/")
+		} else {
+			machines[i] = schema + "://" + node
+		}
+	}
+	return &Client{
+		client:   &http.Client{Transport: transport},
+		nodes:    machines,
+		token:    token,
+		timeout:  requestTimeout,
+		sessions: make(map[string]string),
+	}, nil
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, key := range keys {
+		pairs, _, err := c.list(context.Background(), key, 0)
+		if err != nil {
+			return values, err
+		}
+		prefix := strings.Trim(key, "/")
+		for _, pair := range pairs {
+			if strings.HasSuffix(pair.Key, "/") {
+				continue
+			}
+			if prefix != "" && pair.Key != prefix && !strings.HasPrefix(pair.Key, prefix+"/") {
+				continue
+			}
+			values["/"+pair.Key] = string(pair.Value)
+		}
+	}
+	return values, nil
+}
+
+/*
+* Watch prefix with consul blocking query, block until X-Consul-Index moves beyond
+* waitIndex or stopChan closed. When waitIndex is 0 return current index immediately.
+ */
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		_, index, err := c.list(ctx, prefix, waitIndex)
+		if err != nil {
+			return waitIndex, err
+		}
+		//index may go backwards when consul state is reset, treat it as a change
+		if waitIndex == 0 || index != waitIndex {
+			return index, nil
+		}
+	}
+}
+
+func (c *Client) list(ctx context.Context, prefix string, waitIndex uint64) ([]kvPair, uint64, error) {
+	params := url.Values{}
+	params.Set("recurse", "")
+	timeout := c.timeout
+	if waitIndex > 0 {
+		params.Set("index", strconv.FormatUint(waitIndex, 10))
+		params.Set("wait", strconv.FormatInt(int64(watchWait/time.Second), 10)+"s")
+		timeout += watchWait + watchWait/16
+	}
+	resp, err := c.do(ctx, timeout, "GET", kvPath(prefix)+"?"+params.Encode(), "")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp)
+}
+
+/*
+* do send request to the first node answering within timeout without a server error.
+* The timeout covers reading the response body, it is released by closing the body.
+ */
+func (c *Client) do(ctx context.Context, timeout time.Duration, method, path, body string) (*http.Response, error) {
+	var lastError error
+	for _, node := range c.nodes {
+		req, err := http.NewRequest(method, node+path, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if c.token != "" {
+			req.Header.Set("X-Consul-Token", c.token)
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := c.client.Do(req.WithContext(reqCtx))
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastError = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			//no leader or a failed rpc to the servers, another agent may be fine
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			cancel()
+			lastError = fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(data)))
+			continue
+		}
+		resp.Body = cancelBody{resp.Body, cancel}
+		return resp, nil
+	}
+	return nil, lastError
+}
+
+// cancelBody release the request context when the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func kvPath(key string) string {
+	return "/v1/kv/" + strings.TrimLeft(key, "/")
+}
+
+func decodeResponse(resp *http.Response) ([]kvPair, uint64, error) {
+	var index uint64
+	if h := resp.Header.Get("X-Consul-Index"); h != "" {
+		i, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("bad X-Consul-Index %q", h)
+		}
+		index = i
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, index, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, index, fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var pairs []kvPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, index, err
+	}
+	return pairs, index, nil
+}
+
+// Get return value and modify index of a single key
+func (c *Client) Get(key string) (string, uint64, error) {
+	resp, err := c.do(context.Background(), c.timeout, "GET", kvPath(key), "")
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	pairs, _, err := decodeResponse(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(pairs) == 0 {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return string(pairs[0].Value), pairs[0].ModifyIndex, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	return c.put(txnKV{Verb: "set", Key: key, Value: []byte(value)})
+}
+
+/*
+* SetTTL write key held by a consul session with ttl and the delete behavior, consul
+* removes the key when the session is not renewed in time. Every call renews the session
+* of key, or creates one when it expired. Ttl is bounded to what consul accepts.
+ */
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id := c.sessions[key]
+	if id != "" {
+		renewed, err := c.renewSession(id)
+		if err != nil {
+			return 0, err
+		}
+		if !renewed {
+			id = ""
+		}
+	}
+	if id == "" {
+		var err error
+		if id, err = c.createSession(key, ttl); err != nil {
+			return 0, err
+		}
+		c.sessions[key] = id
+	}
+	return c.put(txnKV{Verb: "lock", Key: key, Value: []byte(value), Session: id})
+}
+
+func (c *Client) createSession(key string, ttl time.Duration) (string, error) {
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	}
+	if ttl > maxSessionTTL {
+		ttl = maxSessionTTL
+	}
+	body, _ := json.Marshal(map[string]string{
+		"Name":      "topod " + key,
+		"TTL":       strconv.FormatInt(int64(ttl/time.Second), 10) + "s",
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	resp, err := c.do(context.Background(), c.timeout, "PUT", "/v1/session/create", string(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var session struct {
+		ID string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+// renewSession reset the session ttl, false when the session already expired
+func (c *Client) renewSession(id string) (bool, error) {
+	resp, err := c.do(context.Background(), c.timeout, "PUT", "/v1/session/renew/"+id, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	return false, fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(data)))
+}
+
+/*
+* Delete remove key in a transaction whose get fails when key is missing, then destroy
+* the session holding it when written by SetTTL.
+ */
+func (c *Client) Delete(key string) error {
+	name := strings.TrimLeft(key, "/")
+	_, err := c.txn(txnKV{Verb: "get", Key: name}, txnKV{Verb: "delete", Key: name})
+	if err == storeerr.ErrCompareFailed {
+		err = storeerr.ErrKeyNotFound
+	}
+	c.lock.Lock()
+	id, ok := c.sessions[key]
+	delete(c.sessions, key)
+	c.lock.Unlock()
+	if ok {
+		if resp, err := c.do(context.Background(), c.timeout, "PUT", "/v1/session/destroy/"+id, ""); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	//delete the key itself and keys under prefix/, not siblings sharing the name prefix
+	if err := c.delete(kvPath(prefix)); err != nil {
+		return err
+	}
+	return c.delete(kvPath(strings.TrimRight(prefix, "/")+"/") + "?recurse")
+}
+
+// CompareAndSwap set key with consul check-and-set, prevIndex 0 only create the key
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	return c.put(txnKV{Verb: "cas", Key: key, Value: []byte(value), Index: prevIndex})
+}
+
+// txnKV is a kv operation of a consul transaction, Value is sent base64 encoded
+type txnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+type txnResponse struct {
+	Results []struct {
+		KV kvPair
+	}
+	Errors []struct {
+		What string
+	}
+}
+
+/*
+* put write a key in a single operation transaction, whose result holds the modify index
+* of this write, not of a later write by another client. A rejected cas or lock returns
+* ErrCompareFailed.
+ */
+func (c *Client) put(op txnKV) (uint64, error) {
+	op.Key = strings.TrimLeft(op.Key, "/")
+	result, err := c.txn(op)
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Results) != 1 {
+		return 0, errors.New("consul: bad transaction response")
+	}
+	return result.Results[0].KV.ModifyIndex, nil
+}
+
+// txn run ops in one consul transaction, a failed operation rolls back all of them and returns ErrCompareFailed
+func (c *Client) txn(ops ...txnKV) (*txnResponse, error) {
+	txn := make([]map[string]txnKV, len(ops))
+	for i, op := range ops {
+		txn[i] = map[string]txnKV{"KV": op}
+	}
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(context.Background(), c.timeout, "PUT", "/v1/txn", string(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	var result txnResponse
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		return &result, nil
+	case http.StatusConflict:
+		//a transaction with a failed operation is rolled back with 409, failed guards or denied access
+		json.Unmarshal(data, &result)
+		for _, e := range result.Errors {
+			if strings.Contains(strings.ToLower(e.What), "denied") {
+				return nil, fmt.Errorf("consul %s: %s", resp.Status, e.What)
+			}
+		}
+		return nil, storeerr.ErrCompareFailed
+	}
+	return nil, fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(data)))
+}
+
+func (c *Client) delete(path string) error {
+	resp, err := c.do(context.Background(), c.timeout, "DELETE", path, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("consul %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// fakeConsul serve the kv, txn and session endpoints used by the client
+type fakeConsul struct {
+	sync.Mutex
+	token string
+	index uint64
+	pairs map[string]kvPair
+	//live sessions with their ttl, and the session holding each locked key
+	sessions map[string]string
+	holders  map[string]string
+	created  int
+	//another client writing the key right after every transaction
+	racer bool
+}
+
+func newFakeConsul(t *testing.T, token string) (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{token: token, index: 9, sessions: make(map[string]string), holders: make(map[string]string), pairs: map[string]kvPair{
+		"app/":        {Key: "app/", Value: nil, ModifyIndex: 3},
+		"app/db/host": {Key: "app/db/host", Value: []byte("10.0.0.1"), ModifyIndex: 5},
+		"app/db/port": {Key: "app/db/port", Value: []byte("3306"), ModifyIndex: 6},
+		"app/dbx":     {Key: "app/dbx", Value: []byte("other"), ModifyIndex: 7},
+	}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Path == "/v1/txn" {
+		f.txn(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/session/") {
+		f.session(w, r)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if r.Method == "DELETE" {
+		delete(f.pairs, prefix)
+		delete(f.holders, prefix)
+		return
+	}
+	//a blocking query at the current index returns after a change
+	if r.URL.Query().Get("index") == "9" {
+		w.Header().Set("X-Consul-Index", "10")
+	} else {
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	}
+	var result []kvPair
+	for _, p := range f.pairs {
+		if strings.HasPrefix(p.Key, prefix) {
+			result = append(result, p)
+		}
+	}
+	if len(result) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []map[string]txnKV
+	json.NewDecoder(r.Body).Decode(&ops)
+	op := ops[0]["KV"]
+	current, exists := f.pairs[op.Key]
+	if op.Verb == "get" {
+		//only the get then delete transaction of Delete
+		if !exists {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"Results":null,"Errors":[{"OpIndex":0,"What":"key %q doesn't exist"}]}`, op.Key)
+			return
+		}
+		delete(f.pairs, op.Key)
+		delete(f.holders, op.Key)
+		f.index++
+		json.NewEncoder(w).Encode(map[string]interface{}{"Results": []map[string]kvPair{{"KV": current}, {"KV": kvPair{}}}})
+		return
+	}
+	if op.Verb == "lock" {
+		if _, ok := f.sessions[op.Session]; !ok || (f.holders[op.Key] != "" && f.holders[op.Key] != op.Session) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"Results":null,"Errors":[{"OpIndex":0,"What":"failed to lock key %q"}]}`, op.Key)
+			return
+		}
+		f.holders[op.Key] = op.Session
+	}
+	if op.Verb == "cas" && (exists != (op.Index != 0) || (exists && current.ModifyIndex != op.Index)) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"Results":null,"Errors":[{"OpIndex":0,"What":"failed to set key %q, index is stale"}]}`, op.Key)
+		return
+	}
+	f.index++
+	pair := kvPair{Key: op.Key, Value: op.Value, ModifyIndex: f.index}
+	f.pairs[op.Key] = pair
+	json.NewEncoder(w).Encode(map[string]interface{}{"Results": []map[string]kvPair{{"KV": pair}}})
+	if f.racer {
+		f.index++
+		f.pairs[op.Key] = kvPair{Key: op.Key, Value: []byte("racer"), ModifyIndex: f.index}
+	}
+}
+
+func (f *fakeConsul) session(w http.ResponseWriter, r *http.Request) {
+	op, id := path.Split(strings.TrimPrefix(r.URL.Path, "/v1/session/"))
+	switch op + id {
+	case "create":
+		var session map[string]string
+		json.NewDecoder(r.Body).Decode(&session)
+		if session["Behavior"] != "delete" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.created++
+		id = "session-" + strconv.Itoa(f.created)
+		f.sessions[id] = session["TTL"]
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+		return
+	}
+	if _, ok := f.sessions[id]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if op == "destroy/" {
+		f.expire(id)
+	}
+}
+
+// expire invalidate session id, deleting the keys it holds
+func (f *fakeConsul) expire(id string) {
+	delete(f.sessions, id)
+	for key, holder := range f.holders {
+		if holder == id {
+			delete(f.pairs, key)
+			delete(f.holders, key)
+		}
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	_, server := newFakeConsul(t, "secret")
+	c, err := NewClient([]string{server.URL}, "http", "", "", "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/app/db", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/app/db/host": "10.0.0.1",
+		"/app/db/port": "3306",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestGetValuesBadToken(t *testing.T) {
+	_, server := newFakeConsul(t, "secret")
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "wrong")
+	if _, err := c.GetValues([]string{"/app"}); err == nil {
+		t.Errorf("GetValues with bad token expect error")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	_, server := newFakeConsul(t, "")
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "No cluster leader")
+	}))
+	defer down.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	c, _ := NewClient([]string{down.URL, hung.URL, server.URL}, "http", "", "", "", "")
+	c.timeout = 50 * time.Millisecond
+	if v, _, err := c.Get("/app/db/host"); err != nil || v != "10.0.0.1" {
+		t.Errorf("Get with failing first nodes = %q, %v, expect 10.0.0.1", v, err)
+	}
+	c, _ = NewClient([]string{down.URL, hung.URL}, "http", "", "", "", "")
+	c.timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, _, err := c.Get("/app/db/host"); err == nil {
+		t.Errorf("Get with no healthy node expect error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Get with a hung node returned after %s", elapsed)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	_, server := newFakeConsul(t, "")
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/app", 0, stopChan)
+	if err != nil || index != 9 {
+		t.Fatalf("WatchPrefix initial index = %d, %v, expect 9", index, err)
+	}
+	index, err = c.WatchPrefix("/app", index, stopChan)
+	if err != nil || index != 10 {
+		t.Fatalf("WatchPrefix changed index = %d, %v, expect 10", index, err)
+	}
+}
+
+func TestWatchPrefixStop(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	stopChan := make(chan bool)
+	errChan := make(chan error)
+	go func() {
+		_, err := c.WatchPrefix("/app", 1, stopChan)
+		errChan <- err
+	}()
+	close(stopChan)
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Errorf("stopped watch expect error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("watch not stopped")
+	}
+}
+
+func TestSetIndex(t *testing.T) {
+	f, server := newFakeConsul(t, "")
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	f.racer = true
+	index, err := c.Set("/app/name", "web")
+	if err != nil || index != 10 {
+		t.Fatalf("Set index = %d, %v, expect 10 of this write, not 11 of the next one", index, err)
+	}
+	f.racer = false
+	if _, err := c.CompareAndSwap("/app/name", "api", index); err != storeerr.ErrCompareFailed {
+		t.Errorf("swap at stale index error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	if _, err := c.CompareAndSwap("/app/db/host", "10.0.0.2", 0); err != storeerr.ErrCompareFailed {
+		t.Errorf("create of existing key error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	index, err = c.CompareAndSwap("/app/db/host", "10.0.0.2", 5)
+	if err != nil || index != 12 {
+		t.Errorf("swap at current index = %d, %v, expect 12", index, err)
+	}
+	if v, i, _ := c.Get("/app/db/host"); v != "10.0.0.2" || i != index {
+		t.Errorf("Get after swap = %s, %d", v, i)
+	}
+	if err := c.Delete("/app/db/host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("/app/db/host"); err != storeerr.ErrKeyNotFound {
+		t.Errorf("delete missing key error = %v, expect %v", err, storeerr.ErrKeyNotFound)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	f, server := newFakeConsul(t, "")
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	index, err := c.SetTTL("/services/web/a", "1", 3*time.Second)
+	if err != nil || index != 10 {
+		t.Fatalf("SetTTL = %d, %v, expect 10", index, err)
+	}
+	if len(f.sessions) != 1 || f.sessions["session-1"] != "10s" || f.holders["services/web/a"] != "session-1" {
+		t.Fatalf("sessions %v holders %v, expect key held by one session of the minimum 10s ttl", f.sessions, f.holders)
+	}
+	//heartbeats renew the session
+	if _, err := c.SetTTL("/services/web/a", "2", 3*time.Second); err != nil || len(f.sessions) != 1 {
+		t.Fatalf("SetTTL heartbeat = %v with %d sessions", err, len(f.sessions))
+	}
+	//an expired session removes the key, the next heartbeat writes it with a new session
+	f.Lock()
+	f.expire("session-1")
+	f.Unlock()
+	if _, _, err := c.Get("/services/web/a"); err != storeerr.ErrKeyNotFound {
+		t.Fatalf("Get after expiry error = %v, expect %v", err, storeerr.ErrKeyNotFound)
+	}
+	if _, err := c.SetTTL("/services/web/a", "3", 3*time.Second); err != nil || f.holders["services/web/a"] != "session-2" {
+		t.Fatalf("SetTTL after expiry = %v, holders %v", err, f.holders)
+	}
+	if v, _, _ := c.Get("/services/web/a"); v != "3" {
+		t.Errorf("Get = %q, expect 3", v)
+	}
+	if err := c.Delete("/services/web/a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.sessions) != 0 {
+		t.Errorf("sessions %v left after Delete", f.sessions)
+	}
+}
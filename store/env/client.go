@@ -0,0 +1,92 @@
+package env
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// Client maps keys like /app/db/host to environment variables like APP_DB_HOST
+type Client struct{}
+
+func NewClient() (*Client, error) {
+	return &Client{}, nil
+}
+
+// implement Store.Client interface, GetValues method. Every environment variable
+// under the key is returned with the key as path prefix, APP_DB_HOST is returned as
+// /app/db/host when key /app/db is queried.
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	environ := os.Environ()
+	values := make(map[string]string)
+	for _, key := range keys {
+		key = path.Join("/", key)
+		name := transform(key)
+		for _, e := range environ {
+			pair := strings.SplitN(e, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			switch {
+			case name == "":
+				values[clean(pair[0])] = pair[1]
+			case pair[0] == name:
+				values[key] = pair[1]
+			case strings.HasPrefix(pair[0], name+"_"):
+				values[path.Join(key, clean(strings.TrimPrefix(pair[0], name+"_")))] = pair[1]
+			}
+		}
+	}
+	return values, nil
+}
+
+// Environment is static for the process, block until stopChan closed
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	if waitIndex == 0 {
+		return 1, nil
+	}
+	<-stopChan
+	return waitIndex, errors.New("env watch stopped")
+}
+
+func transform(key string) string {
+	k := strings.Trim(key, "/")
+	k = strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(k)
+	return strings.ToUpper(k)
+}
+
+func clean(name string) string {
+	return path.Join("/", strings.Replace(strings.ToLower(name), "_", "/", -1))
+}
+
+// Get return value of a single key, environment is read only and have no index
+func (c *Client) Get(key string) (string, uint64, error) {
+	values, err := c.GetValues([]string{key})
+	if err != nil {
+		return "", 0, err
+	}
+	v, ok := values[path.Join("/", key)]
+	if !ok {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return v, 0, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
+
+func (c *Client) Delete(key string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
@@ -0,0 +1,32 @@
+package env
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGetValues(t *testing.T) {
+	os.Setenv("TOPOD_TEST_DB_HOST", "10.0.0.1")
+	os.Setenv("TOPOD_TEST_DB_PORT", "3306")
+	os.Setenv("TOPOD_TEST_DBX", "other")
+	os.Setenv("TOPOD_TEST_NAME", "app")
+	defer func() {
+		for _, e := range []string{"TOPOD_TEST_DB_HOST", "TOPOD_TEST_DB_PORT", "TOPOD_TEST_DBX", "TOPOD_TEST_NAME"} {
+			os.Unsetenv(e)
+		}
+	}()
+	c, _ := NewClient()
+	values, err := c.GetValues([]string{"/topod-test/db", "/topod-test/name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/topod-test/db/host": "10.0.0.1",
+		"/topod-test/db/port": "3306",
+		"/topod-test/name":    "app",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
@@ -1,16 +1,46 @@
 package etcd
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
-	"sync"
 	"time"
 
 	goetcd "github.com/coreos/go-etcd/etcd"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+const (
+	errorCodeKeyNotFound = 100
+	errorCodeTestFailed  = 101
+	errorCodeNodeExist   = 105
+	//max concurrent get requests of one GetValues call
+	maxConcurrentFetch = 8
+	fetchTimeout       = 10 * time.Second
 )
 
+//KeysAPI is the part of go-etcd client used by the store
+type KeysAPI interface {
+	Get(key string, sort, recursive bool) (*goetcd.Response, error)
+	Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *goetcd.Response, stop chan bool) (*goetcd.Response, error)
+	Set(key, value string, ttl uint64) (*goetcd.Response, error)
+	Create(key, value string, ttl uint64) (*goetcd.Response, error)
+	Delete(key string, recursive bool) (*goetcd.Response, error)
+	CompareAndSwap(key, value string, ttl uint64, prevValue string, prevIndex uint64) (*goetcd.Response, error)
+}
+
 type Client struct {
-	Client *goetcd.Client
+	Client  KeysAPI
+	timeout time.Duration
+	//slots of the get requests in flight, shared by all GetValues calls
+	fetches chan struct{}
+}
+
+type fetchResult struct {
+	values map[string]string
+	err    error
 }
 
 /*
@@ -23,7 +53,7 @@ func NewClient(machines []string, cert, key, caCert string) (*Client, error) {
 	if key != "" && cert != "" {
 		c, err = goetcd.NewTLSClient(machines, cert, key, caCert)
 		if err != nil {
-			return &Client{c}, err
+			return newClient(c), err
 		}
 	} else {
 		c = goetcd.NewClient(machines)
@@ -33,29 +63,84 @@ func NewClient(machines []string, cert, key, caCert string) (*Client, error) {
 	if !success {
 		err = errors.New("can not connect to etcd cluster: " + strings.Join(machines, ", "))
 	}
-	return &Client{c}, err
+	return newClient(c), err
+}
+
+func newClient(keys KeysAPI) *Client {
+	return &Client{Client: keys, timeout: fetchTimeout, fetches: make(chan struct{}, maxConcurrentFetch)}
 }
 
 //implement Store.Client interface, GetValues method
+//Keys not found are skipped, any other fetch error is returned
 func (c *Client) GetValues(keys []string) (map[string]string, error) {
-	var waitGroup sync.WaitGroup
-	values := make(map[string]string)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.getValues(ctx, keys)
+}
+
+/*
+* Fetch keys with at most maxConcurrentFetch requests in flight, every fetch fills its
+* own map and results are merged here, so no map is shared between goroutines.
+* Results channel is buffered for all keys, fetches finishing after ctx is done never block.
+* A fetch holds its slot until its request returns, also after ctx is done, so requests
+* left running by a timed out call count against the bound of the next calls.
+ */
+func (c *Client) getValues(ctx context.Context, keys []string) (map[string]string, error) {
+	results := make(chan fetchResult, len(keys))
 	for _, key := range keys {
-		waitGroup.Add(1)
-		go fetchValue(c, key, values, &waitGroup)
+		go func(key string) {
+			select {
+			case c.fetches <- struct{}{}:
+			case <-ctx.Done():
+				results <- fetchResult{err: ctx.Err()}
+				return
+			}
+			defer func() { <-c.fetches }()
+			values, err := c.fetchValue(key)
+			results <- fetchResult{values, err}
+		}(key)
 	}
-	waitGroup.Wait()
-	return values, nil
+	values := make(map[string]string)
+	var lastError error
+	for range keys {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				lastError = r.err
+				continue
+			}
+			for k, v := range r.values {
+				values[k] = v
+			}
+		case <-ctx.Done():
+			return values, fmt.Errorf("fetch keys from etcd error: %s", ctx.Err().Error())
+		}
+	}
+	return values, lastError
 }
 
-func fetchValue(c *Client, key string, values map[string]string, waitGroup *sync.WaitGroup) error {
-	defer waitGroup.Done()
+func (c *Client) fetchValue(key string) (map[string]string, error) {
+	values := make(map[string]string)
 	resp, err := c.Client.Get(key, true, true)
 	if err != nil {
-		return err
+		if isKeyNotFound(err) {
+			return values, nil
+		}
+		return nil, err
 	}
 	err = nodesErgodic(resp.Node, values)
-	return err
+	return values, err
+}
+
+func isKeyNotFound(err error) bool {
+	return errorCode(err) == errorCodeKeyNotFound
+}
+
+func errorCode(err error) int {
+	if e, ok := err.(*goetcd.EtcdError); ok {
+		return e.ErrorCode
+	}
+	return 0
 }
 
 func nodesErgodic(node *goetcd.Node, values map[string]string) error {
@@ -73,16 +158,97 @@ func nodesErgodic(node *goetcd.Node, values map[string]string) error {
 }
 
 func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	index, _, err := c.WatchPrefixKeys(prefix, waitIndex, stopChan)
+	return index, err
+}
+
+//WatchPrefixKeys is WatchPrefix returning the key of the first event after waitIndex
+func (c *Client) WatchPrefixKeys(prefix string, waitIndex uint64, stopChan chan bool) (uint64, []string, error) {
 	if waitIndex == 0 {
 		resp, err := c.Client.Get(prefix, false, true)
 		if err != nil {
-			return 0, err
+			return 0, nil, err
 		}
-		return resp.EtcdIndex, nil
+		return resp.EtcdIndex, nil, nil
 	}
 	resp, err := c.Client.Watch(prefix, waitIndex+1, true, nil, stopChan)
 	if err != nil {
+		return 0, nil, err
+	}
+	return resp.Node.ModifiedIndex, []string{resp.Node.Key}, err
+}
+
+//Get return value and modified index of a single key
+func (c *Client) Get(key string) (string, uint64, error) {
+	resp, err := c.Client.Get(key, false, false)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return "", 0, storeerr.ErrKeyNotFound
+		}
+		return "", 0, err
+	}
+	if resp.Node.Dir {
+		return "", 0, errors.New(key + " is a directory")
+	}
+	return resp.Node.Value, resp.Node.ModifiedIndex, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	resp, err := c.Client.Set(key, value, 0)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+//SetTTL set key expiring after ttl, rounded up to whole seconds
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	resp, err := c.Client.Set(key, value, ttlSeconds(ttl))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (c *Client) Delete(key string) error {
+	_, err := c.Client.Delete(key, false)
+	if isKeyNotFound(err) {
+		return storeerr.ErrKeyNotFound
+	}
+	return err
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	_, err := c.Client.Delete(prefix, true)
+	if isKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+//CompareAndSwap set key only when its modified index is prevIndex, prevIndex 0 create the key
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	var resp *goetcd.Response
+	var err error
+	if prevIndex == 0 {
+		resp, err = c.Client.Create(key, value, 0)
+	} else {
+		resp, err = c.Client.CompareAndSwap(key, value, 0, "", prevIndex)
+	}
+	if err != nil {
+		switch errorCode(err) {
+		case errorCodeTestFailed, errorCodeNodeExist, errorCodeKeyNotFound:
+			return 0, storeerr.ErrCompareFailed
+		}
 		return 0, err
 	}
-	return resp.Node.ModifiedIndex, err
+	return resp.Node.ModifiedIndex, nil
+}
+
+func ttlSeconds(ttl time.Duration) uint64 {
+	seconds := uint64((ttl + time.Second - 1) / time.Second)
+	if seconds == 0 {
+		return 1
+	}
+	return seconds
 }
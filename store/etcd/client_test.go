@@ -0,0 +1,257 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goetcd "github.com/coreos/go-etcd/etcd"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// fakeEtcd serve the v2 members and keys api over a flat key space
+type fakeEtcd struct {
+	sync.Mutex
+	values   map[string]string
+	indexes  map[string]uint64
+	index    uint64
+	failKey  string
+	block    chan struct{}
+	inflight int32
+	maxSeen  int32
+}
+
+func newFakeEtcd(t *testing.T, n int) (*fakeEtcd, *Client) {
+	f := &fakeEtcd{values: make(map[string]string), indexes: make(map[string]uint64), index: 1}
+	for i := 0; i < n; i++ {
+		f.values[fmt.Sprintf("/app/%d/key", i)] = strconv.Itoa(i)
+		f.indexes[fmt.Sprintf("/app/%d/key", i)] = 1
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	c, err := NewClient([]string{server.URL}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/members" {
+		fmt.Fprintf(w, `{"members":[{"id":"1","name":"default","clientURLs":["http://%s"]}]}`, r.Host)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("wait") == "true":
+		f.watch(w, r, key)
+	case r.Method == "GET":
+		f.get(w, r, key)
+	case r.Method == "PUT":
+		f.put(w, r, key)
+	case r.Method == "DELETE":
+		f.Lock()
+		defer f.Unlock()
+		if _, ok := f.values[key]; !ok {
+			f.error(w, http.StatusNotFound, errorCodeKeyNotFound, key)
+			return
+		}
+		delete(f.values, key)
+		f.index++
+		f.reply(w, http.StatusOK, "delete", &goetcd.Node{Key: key, ModifiedIndex: f.index})
+	}
+}
+
+func (f *fakeEtcd) get(w http.ResponseWriter, r *http.Request, key string) {
+	n := atomic.AddInt32(&f.inflight, 1)
+	defer atomic.AddInt32(&f.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxSeen)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxSeen, max, n) {
+			break
+		}
+	}
+	if f.block != nil {
+		<-f.block
+	}
+	time.Sleep(time.Millisecond)
+	if key == f.failKey {
+		//drop the connection like a dead member
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if v, ok := f.values[key]; ok {
+		f.reply(w, http.StatusOK, "get", &goetcd.Node{Key: key, Value: v, ModifiedIndex: f.indexes[key]})
+		return
+	}
+	dir := &goetcd.Node{Key: key, Dir: true}
+	for k, v := range f.values {
+		if strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/") {
+			dir.Nodes = append(dir.Nodes, &goetcd.Node{Key: k, Value: v, ModifiedIndex: f.indexes[k]})
+		}
+	}
+	if len(dir.Nodes) == 0 && key != "/" {
+		f.error(w, http.StatusNotFound, errorCodeKeyNotFound, key)
+		return
+	}
+	f.reply(w, http.StatusOK, "get", dir)
+}
+
+// watch reply the first key under prefix modified at waitIndex or later, polling until the client goes away
+func (f *fakeEtcd) watch(w http.ResponseWriter, r *http.Request, prefix string) {
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("waitIndex"), 10, 64)
+	for {
+		f.Lock()
+		for k, index := range f.indexes {
+			if index >= waitIndex && (k == prefix || strings.HasPrefix(k, prefix+"/")) {
+				f.reply(w, http.StatusOK, "set", &goetcd.Node{Key: k, Value: f.values[k], ModifiedIndex: index})
+				f.Unlock()
+				return
+			}
+		}
+		f.Unlock()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (f *fakeEtcd) put(w http.ResponseWriter, r *http.Request, key string) {
+	r.ParseForm()
+	f.Lock()
+	defer f.Unlock()
+	_, exists := f.values[key]
+	if r.Form.Get("prevExist") == "false" && exists {
+		f.error(w, http.StatusPreconditionFailed, errorCodeNodeExist, key)
+		return
+	}
+	if prevIndex := r.Form.Get("prevIndex"); prevIndex != "" {
+		if !exists {
+			f.error(w, http.StatusNotFound, errorCodeKeyNotFound, key)
+			return
+		}
+		if prevIndex != strconv.FormatUint(f.indexes[key], 10) {
+			f.error(w, http.StatusPreconditionFailed, errorCodeTestFailed, key)
+			return
+		}
+	}
+	f.index++
+	f.values[key] = r.Form.Get("value")
+	f.indexes[key] = f.index
+	ttl, _ := strconv.ParseInt(r.Form.Get("ttl"), 10, 64)
+	f.reply(w, http.StatusCreated, "set", &goetcd.Node{Key: key, Value: f.values[key], TTL: ttl, ModifiedIndex: f.index})
+}
+
+func (f *fakeEtcd) reply(w http.ResponseWriter, status int, action string, node *goetcd.Node) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&goetcd.Response{Action: action, Node: node})
+}
+
+func (f *fakeEtcd) error(w http.ResponseWriter, status, code int, key string) {
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&goetcd.EtcdError{ErrorCode: code, Message: http.StatusText(status), Cause: key, Index: f.index})
+}
+
+func TestGetValues(t *testing.T) {
+	f, c := newFakeEtcd(t, 100)
+	keys := []string{"/missing"}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("/app/%d", i))
+	}
+	values, err := c.GetValues(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, f.values) {
+		t.Errorf("GetValues = %v, expect %v", values, f.values)
+	}
+	if atomic.LoadInt32(&f.maxSeen) > maxConcurrentFetch {
+		t.Errorf("concurrent fetch = %d, expect at most %d", f.maxSeen, maxConcurrentFetch)
+	}
+}
+
+func TestGetValuesError(t *testing.T) {
+	f, c := newFakeEtcd(t, 10)
+	f.failKey = "/app/3"
+	if _, err := c.GetValues([]string{"/app/1", "/app/3"}); err == nil {
+		t.Errorf("GetValues with transport failure expect error")
+	}
+}
+
+func TestGetValuesTimeout(t *testing.T) {
+	f, c := newFakeEtcd(t, 20)
+	f.block = make(chan struct{})
+	defer close(f.block)
+	c.timeout = 10 * time.Millisecond
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("/app/%d", i))
+	}
+	if _, err := c.GetValues(keys[:10]); err == nil {
+		t.Errorf("GetValues blocked expect timeout error")
+	}
+	//requests left running by the timed out call still hold their slots
+	if _, err := c.GetValues(keys[10:]); err == nil {
+		t.Errorf("GetValues blocked expect timeout error")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&f.maxSeen); n > maxConcurrentFetch {
+		t.Errorf("concurrent fetch = %d across timed out calls, expect at most %d", n, maxConcurrentFetch)
+	}
+}
+
+func TestWatchPrefixKeys(t *testing.T) {
+	_, c := newFakeEtcd(t, 2)
+	stopChan := make(chan bool)
+	index, _, err := c.WatchPrefixKeys("/app", 0, stopChan)
+	if err != nil || index != 1 {
+		t.Fatalf("WatchPrefixKeys initial index = %d, %v, expect 1", index, err)
+	}
+	set, err := c.Set("/app/1/key", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, keys, err := c.WatchPrefixKeys("/app", index, stopChan)
+	if err != nil || index != set || !reflect.DeepEqual(keys, []string{"/app/1/key"}) {
+		t.Errorf("WatchPrefixKeys = %d, %v, %v, expect %d, [/app/1/key]", index, keys, err, set)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	_, c := newFakeEtcd(t, 0)
+	index, err := c.CompareAndSwap("/app/key", "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CompareAndSwap("/app/key", "1", 0); err != storeerr.ErrCompareFailed {
+		t.Errorf("create existing key error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	if _, err := c.CompareAndSwap("/app/key", "2", index+1); err != storeerr.ErrCompareFailed {
+		t.Errorf("swap with stale index error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	if _, err := c.CompareAndSwap("/app/key", "2", index); err != nil {
+		t.Errorf("swap with current index error = %v", err)
+	}
+	if v, _, _ := c.Get("/app/key"); v != "2" {
+		t.Errorf("Get after swap = %q, expect 2", v)
+	}
+	if err := c.Delete("/app/missing"); err != storeerr.ErrKeyNotFound {
+		t.Errorf("delete missing key error = %v, expect %v", err, storeerr.ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,524 @@
+package etcdv3
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+const requestTimeout = 3 * time.Second
+
+// DefaultGateway is the json gateway path of etcd 3.4 and later
+const DefaultGateway = "/v3"
+
+/*
+* Client talks to etcd v3 through its grpc json gateway, not the grpc api, so the
+* gateway must be served by etcd on the client urls, as it is by default. Its path
+* changed across etcd versions: /v3 since 3.4, /v3beta on 3.3 and /v3alpha before.
+* Keys are read with range requests and prefixes watched with the watch stream keyed
+* by revision.
+ */
+type Client struct {
+	client  *http.Client
+	nodes   []string
+	gateway string
+	lock    sync.Mutex
+	//leases holding keys written by SetTTL
+	leases map[string]string
+}
+
+type keyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type responseHeader struct {
+	Revision string `json:"revision"`
+}
+
+type rangeRequest struct {
+	Key       string `json:"key"`
+	RangeEnd  string `json:"range_end,omitempty"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+type leaseGrantResponse struct {
+	ID    string `json:"ID"`
+	Error string `json:"error"`
+}
+
+type leaseKeepAliveResponse struct {
+	Result struct {
+		TTL string `json:"TTL"`
+	} `json:"result"`
+}
+
+type deleteRangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
+
+type compare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    string `json:"mod_revision,omitempty"`
+	CreateRevision string `json:"create_revision,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare                `json:"compare"`
+	Success []map[string]interface{} `json:"success"`
+}
+
+type txnResponse struct {
+	Header    responseHeader `json:"header"`
+	Succeeded bool           `json:"succeeded"`
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []keyValue     `json:"kvs"`
+}
+
+type watchCreateRequest struct {
+	Key           string `json:"key"`
+	RangeEnd      string `json:"range_end,omitempty"`
+	StartRevision string `json:"start_revision,omitempty"`
+}
+
+type watchEvent struct {
+	Type string   `json:"type"`
+	Kv   keyValue `json:"kv"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Header          responseHeader `json:"header"`
+		Created         bool           `json:"created"`
+		Canceled        bool           `json:"canceled"`
+		CompactRevision string         `json:"compact_revision"`
+		CancelReason    string         `json:"cancel_reason"`
+		Events          []watchEvent   `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+/*
+*	New etcd v3 client from nodes list host:port, return *etcdv3.Client
+*	Use https when schema is https or client cert is given, gateway is the json gateway
+*	path, DefaultGateway when empty
+ */
+func NewClient(nodes []string, schema, cert, key, caCert, gateway string) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("empty etcd nodes")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if schema == "" {
+		schema = "http"
+	}
+	if (cert != "" && key != "") || caCert != "" {
+		schema = "https"
+		tlsConfig := &tls.Config{}
+		if cert != "" && key != "" {
+			certificate, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		if caCert != "" {
+			ca, err := ioutil.ReadFile(caCert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.New("invalid etcd ca cert " + caCert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	machines := make([]string, len(nodes))
+	for i, node := range nodes {
+		if strings.Contains(node, "://") {
+			machines[i] = strings.TrimRight(node, "/")
+		} else {
+			machines[i] = schema + "://" + node
+		}
+	}
+	if gateway == "" {
+		gateway = DefaultGateway
+	}
+	return &Client{
+		client:  &http.Client{Transport: transport},
+		nodes:   machines,
+		gateway: "/" + strings.Trim(gateway, "/"),
+		leases:  make(map[string]string),
+	}, nil
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, key := range keys {
+		resp, err := c.rangePrefix(key, false)
+		if err != nil {
+			return values, err
+		}
+		for _, kv := range resp.Kvs {
+			k, err := decode(kv.Key)
+			if err != nil {
+				return values, err
+			}
+			if k != key && !strings.HasPrefix(k, strings.TrimRight(key, "/")+"/") {
+				continue
+			}
+			v, err := decode(kv.Value)
+			if err != nil {
+				return values, err
+			}
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+/*
+* Watch prefix from revision waitIndex+1, return the highest mod revision of the
+* received events. When waitIndex is 0 return current store revision immediately.
+* If the wanted revision has been compacted, return current revision so the caller
+* does a full resync and continues watching from there.
+ */
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	index, _, err := c.WatchPrefixKeys(prefix, waitIndex, stopChan)
+	return index, err
+}
+
+// WatchPrefixKeys is WatchPrefix returning the keys of the first watch response after waitIndex,
+// keys are nil when the revision is compacted and the changes are lost
+func (c *Client) WatchPrefixKeys(prefix string, waitIndex uint64, stopChan chan bool) (uint64, []string, error) {
+	if waitIndex == 0 {
+		index, err := c.revision(prefix)
+		return index, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	body, err := json.Marshal(map[string]watchCreateRequest{
+		"create_request": {
+			Key:           encode(prefix),
+			RangeEnd:      encode(prefixEnd(prefix)),
+			StartRevision: strconv.FormatUint(waitIndex+1, 10),
+		},
+	})
+	if err != nil {
+		return waitIndex, nil, err
+	}
+	resp, err := c.post(ctx, c.gateway+"/watch", body)
+	if err != nil {
+		return waitIndex, nil, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var wr watchResponse
+		if err := decoder.Decode(&wr); err != nil {
+			if ctx.Err() != nil {
+				return waitIndex, nil, ctx.Err()
+			}
+			return waitIndex, nil, err
+		}
+		if wr.Error != nil {
+			return waitIndex, nil, errors.New("etcd watch error: " + wr.Error.Message)
+		}
+		if compacted, _ := parseRevision(wr.Result.CompactRevision); compacted > 0 {
+			index, err := c.revision(prefix)
+			return index, nil, err
+		}
+		if wr.Result.Canceled {
+			return waitIndex, nil, errors.New("etcd watch canceled: " + wr.Result.CancelReason)
+		}
+		var index uint64
+		var keys []string
+		for _, event := range wr.Result.Events {
+			rev, err := parseRevision(event.Kv.ModRevision)
+			if err != nil {
+				return waitIndex, nil, err
+			}
+			if rev > index {
+				index = rev
+			}
+			key, err := decode(event.Kv.Key)
+			if err != nil {
+				return waitIndex, nil, err
+			}
+			keys = append(keys, key)
+		}
+		if index > 0 {
+			return index, keys, nil
+		}
+	}
+}
+
+func (c *Client) revision(prefix string) (uint64, error) {
+	resp, err := c.rangePrefix(prefix, true)
+	if err != nil {
+		return 0, err
+	}
+	return parseRevision(resp.Header.Revision)
+}
+
+func (c *Client) rangePrefix(prefix string, countOnly bool) (*rangeResponse, error) {
+	var result rangeResponse
+	err := c.call(c.gateway+"/kv/range", rangeRequest{
+		Key:       encode(prefix),
+		RangeEnd:  encode(prefixEnd(prefix)),
+		CountOnly: countOnly,
+	}, &result)
+	return &result, err
+}
+
+// call post a json request with request timeout and decode the response into result
+func (c *Client) call(path string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	var lastError error
+	for _, node := range c.nodes {
+		req, err := http.NewRequest("POST", node+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastError = err
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, fmt.Errorf("etcd %s: no json gateway at %s, check the gateway_prefix of the etcd version", resp.Status, node+c.gateway)
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("etcd %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return resp, nil
+	}
+	return nil, lastError
+}
+
+// Get return value and mod revision of a single key
+func (c *Client) Get(key string) (string, uint64, error) {
+	var result rangeResponse
+	if err := c.call(c.gateway+"/kv/range", rangeRequest{Key: encode(key)}, &result); err != nil {
+		return "", 0, err
+	}
+	if len(result.Kvs) == 0 {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	value, err := decode(result.Kvs[0].Value)
+	if err != nil {
+		return "", 0, err
+	}
+	index, err := parseRevision(result.Kvs[0].ModRevision)
+	return value, index, err
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	var result rangeResponse
+	if err := c.call(c.gateway+"/kv/put", putRequest{Key: encode(key), Value: encode(value)}, &result); err != nil {
+		return 0, err
+	}
+	return parseRevision(result.Header.Revision)
+}
+
+/*
+* SetTTL put key attached to a lease of ttl, rounded up to whole seconds. Every call
+* refreshes the lease of key with a keepalive, or grants one when it expired, so a key
+* refreshed as a heartbeat keeps a single lease.
+ */
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id := c.leases[key]
+	if id != "" {
+		alive, err := c.keepAlive(id)
+		if err != nil {
+			return 0, err
+		}
+		if !alive {
+			id = ""
+		}
+	}
+	if id == "" {
+		var err error
+		if id, err = c.grantLease(ttl); err != nil {
+			return 0, err
+		}
+		c.leases[key] = id
+	}
+	var result rangeResponse
+	if err := c.call(c.gateway+"/kv/put", putRequest{Key: encode(key), Value: encode(value), Lease: id}, &result); err != nil {
+		return 0, err
+	}
+	return parseRevision(result.Header.Revision)
+}
+
+func (c *Client) grantLease(ttl time.Duration) (string, error) {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	var lease leaseGrantResponse
+	if err := c.call(c.gateway+"/lease/grant", map[string]string{"TTL": strconv.FormatInt(seconds, 10)}, &lease); err != nil {
+		return "", err
+	}
+	if lease.ID == "" {
+		return "", errors.New("etcd lease grant failed: " + lease.Error)
+	}
+	return lease.ID, nil
+}
+
+// keepAlive refresh lease id with a single keepalive request, false when it already expired
+func (c *Client) keepAlive(id string) (bool, error) {
+	var result leaseKeepAliveResponse
+	if err := c.call(c.gateway+"/lease/keepalive", map[string]string{"ID": id}, &result); err != nil {
+		return false, err
+	}
+	//etcd answers ttl 0 for an expired lease
+	return result.Result.TTL != "" && result.Result.TTL != "0", nil
+}
+
+// Delete remove key, and revoke the lease holding it when written by SetTTL
+func (c *Client) Delete(key string) error {
+	var result struct {
+		Deleted string `json:"deleted"`
+	}
+	err := c.call(c.gateway+"/kv/deleterange", deleteRangeRequest{Key: encode(key)}, &result)
+	if err == nil && (result.Deleted == "" || result.Deleted == "0") {
+		err = storeerr.ErrKeyNotFound
+	}
+	c.lock.Lock()
+	id, ok := c.leases[key]
+	delete(c.leases, key)
+	c.lock.Unlock()
+	if ok {
+		//kv/lease/revoke is served by every gateway version, lease/revoke only since 3.4
+		var revoked struct{}
+		c.call(c.gateway+"/kv/lease/revoke", map[string]string{"ID": id}, &revoked)
+	}
+	return err
+}
+
+// DeleteTree delete the key itself and keys under prefix/, not siblings sharing the name prefix
+func (c *Client) DeleteTree(prefix string) error {
+	var result struct{}
+	if err := c.call(c.gateway+"/kv/deleterange", deleteRangeRequest{Key: encode(prefix)}, &result); err != nil {
+		return err
+	}
+	children := strings.TrimRight(prefix, "/") + "/"
+	return c.call(c.gateway+"/kv/deleterange", deleteRangeRequest{
+		Key:      encode(children),
+		RangeEnd: encode(prefixEnd(children)),
+	}, &result)
+}
+
+// CompareAndSwap put key in a txn guarded by its mod revision, prevIndex 0 guard the key does not exist
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	cmp := compare{Key: encode(key), Result: "EQUAL"}
+	if prevIndex == 0 {
+		cmp.Target = "CREATE"
+		cmp.CreateRevision = "0"
+	} else {
+		cmp.Target = "MOD"
+		cmp.ModRevision = strconv.FormatUint(prevIndex, 10)
+	}
+	var result txnResponse
+	err := c.call(c.gateway+"/kv/txn", txnRequest{
+		Compare: []compare{cmp},
+		Success: []map[string]interface{}{{"request_put": putRequest{Key: encode(key), Value: encode(value)}}},
+	}, &result)
+	if err != nil {
+		return 0, err
+	}
+	if !result.Succeeded {
+		return 0, storeerr.ErrCompareFailed
+	}
+	return parseRevision(result.Header.Revision)
+}
+
+// prefixEnd return the range end which covers all keys with the given prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	//whole key space
+	return "\x00"
+}
+
+func parseRevision(rev string) (uint64, error) {
+	if rev == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(rev, 10, 64)
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
@@ -0,0 +1,230 @@
+package etcdv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+type fakeEtcd struct {
+	sync.Mutex
+	revision  uint64
+	compacted uint64
+	kvs       map[string]string
+	//json gateway path, /v3 when empty
+	gateway string
+	//live leases with their keys, and the count of leases granted
+	leases  map[string][]string
+	granted int
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gateway := f.gateway
+	if gateway == "" {
+		gateway = "/v3"
+	}
+	if !strings.HasPrefix(r.URL.Path, gateway+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	switch strings.TrimPrefix(r.URL.Path, gateway) {
+	case "/kv/put":
+		var req putRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		key, _ := decode(req.Key)
+		value, _ := decode(req.Value)
+		if _, ok := f.leases[req.Lease]; req.Lease != "" && !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"etcdserver: requested lease not found"}`)
+			return
+		}
+		f.revision++
+		f.kvs[key] = value
+		if req.Lease != "" {
+			f.leases[req.Lease] = append(f.leases[req.Lease], key)
+		}
+		json.NewEncoder(w).Encode(rangeResponse{Header: responseHeader{Revision: fmt.Sprint(f.revision)}})
+	case "/kv/deleterange":
+		var req deleteRangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		key, _ := decode(req.Key)
+		deleted := 0
+		if _, ok := f.kvs[key]; ok {
+			delete(f.kvs, key)
+			deleted = 1
+		}
+		fmt.Fprintf(w, `{"deleted":"%d"}`, deleted)
+	case "/lease/grant":
+		f.granted++
+		id := strconv.Itoa(f.granted)
+		f.leases[id] = nil
+		fmt.Fprintf(w, `{"ID":"%s","TTL":"10"}`, id)
+	case "/lease/keepalive":
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		ttl := "0"
+		if _, ok := f.leases[req["ID"]]; ok {
+			ttl = "10"
+		}
+		fmt.Fprintf(w, `{"result":{"ID":"%s","TTL":"%s"}}`+"\n", req["ID"], ttl)
+	case "/kv/lease/revoke":
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		f.expire(req["ID"])
+		fmt.Fprint(w, `{}`)
+	case "/kv/range":
+		var req rangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		key, _ := decode(req.Key)
+		end, _ := decode(req.RangeEnd)
+		resp := rangeResponse{Header: responseHeader{Revision: fmt.Sprint(f.revision)}}
+		if !req.CountOnly {
+			for k, v := range f.kvs {
+				if k == key || (k >= key && k < end) {
+					resp.Kvs = append(resp.Kvs, keyValue{Key: encode(k), Value: encode(v), ModRevision: "1"})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/watch":
+		var req map[string]watchCreateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		start, _ := parseRevision(req["create_request"].StartRevision)
+		key, _ := decode(req["create_request"].Key)
+		rev := fmt.Sprint(f.revision)
+		fmt.Fprintf(w, `{"result":{"header":{"revision":"%s"},"created":true}}`+"\n", rev)
+		if start <= f.compacted {
+			fmt.Fprintf(w, `{"result":{"header":{"revision":"%s"},"canceled":true,"compact_revision":"%d"}}`+"\n", rev, f.compacted)
+			return
+		}
+		fmt.Fprintf(w, `{"result":{"header":{"revision":"%s"},"events":[{"kv":{"key":"%s","value":"%s","mod_revision":"%d"}}]}}`+"\n",
+			rev, encode(key+"/x"), encode("1"), start)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// expire drop lease id with the keys attached to it
+func (f *fakeEtcd) expire(id string) {
+	for _, key := range f.leases[id] {
+		delete(f.kvs, key)
+	}
+	delete(f.leases, id)
+}
+
+func TestGetValues(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{revision: 10, kvs: map[string]string{
+		"/app/db/host": "10.0.0.1",
+		"/app/db/port": "3306",
+		"/app/dbx":     "other",
+	}})
+	defer server.Close()
+	c, err := NewClient([]string{server.URL}, "http", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/app/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"/app/db/host": "10.0.0.1", "/app/db/port": "3306"}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{revision: 10, compacted: 5})
+	defer server.Close()
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/app", 0, stopChan)
+	if err != nil || index != 10 {
+		t.Fatalf("WatchPrefix initial revision = %d, %v, expect 10", index, err)
+	}
+	index, keys, err := c.WatchPrefixKeys("/app", 10, stopChan)
+	if err != nil || index != 11 {
+		t.Fatalf("WatchPrefix event revision = %d, %v, expect 11", index, err)
+	}
+	if !reflect.DeepEqual(keys, []string{"/app/x"}) {
+		t.Errorf("WatchPrefixKeys keys = %v, expect [/app/x]", keys)
+	}
+	//compacted revision resync to current revision
+	index, err = c.WatchPrefix("/app", 3, stopChan)
+	if err != nil || index != 10 {
+		t.Fatalf("WatchPrefix compacted revision = %d, %v, expect 10", index, err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expect := range map[string]string{
+		"/app":     "/apq",
+		"a\xff":    "b",
+		"\xff\xff": "\x00",
+	} {
+		if end := prefixEnd(prefix); end != expect {
+			t.Errorf("prefixEnd(%q) = %q, expect %q", prefix, end, expect)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{revision: 10, gateway: "/v3beta", kvs: map[string]string{"/app/port": "80"}})
+	defer server.Close()
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	if _, err := c.GetValues([]string{"/app"}); err == nil || !strings.Contains(err.Error(), "gateway_prefix") {
+		t.Errorf("GetValues on another gateway path error = %v, expect a hint to gateway_prefix", err)
+	}
+	c, _ = NewClient([]string{server.URL}, "http", "", "", "", "/v3beta/")
+	values, err := c.GetValues([]string{"/app"})
+	if err != nil || values["/app/port"] != "80" {
+		t.Errorf("GetValues through /v3beta = %v, %v", values, err)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	f := &fakeEtcd{revision: 10, kvs: make(map[string]string), leases: make(map[string][]string)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "")
+	for i := 0; i < 3; i++ {
+		if _, err := c.SetTTL("/services/web/a", strconv.Itoa(i), 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Lock()
+	if f.granted != 1 || len(f.leases) != 1 {
+		t.Errorf("leases granted %d, live %v after 3 heartbeats, expect a single lease", f.granted, f.leases)
+	}
+	//an expired lease removes the key, the next heartbeat writes it with a new lease
+	f.expire("1")
+	f.Unlock()
+	if _, err := c.SetTTL("/services/web/a", "3", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := c.Get("/services/web/a"); err != nil || v != "3" {
+		t.Errorf("Get after lease expiry = %q, %v, expect 3", v, err)
+	}
+	if err := c.Delete("/services/web/a"); err != nil {
+		t.Fatal(err)
+	}
+	f.Lock()
+	if f.granted != 2 || len(f.leases) != 0 {
+		t.Errorf("leases granted %d, live %v after Delete, expect the second lease revoked", f.granted, f.leases)
+	}
+	f.Unlock()
+	if err := c.Delete("/services/web/a"); err != storeerr.ErrKeyNotFound {
+		t.Errorf("delete missing key error = %v, expect %v", err, storeerr.ErrKeyNotFound)
+	}
+}
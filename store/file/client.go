@@ -0,0 +1,188 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+// Client reads keys from local yaml, json or toml files, nested maps are
+// flattened to /a/b/c paths and list items to /a/0, /a/1 paths.
+type Client struct {
+	files    []string
+	interval time.Duration
+}
+
+func NewClient(files []string) (*Client, error) {
+	if len(files) == 0 {
+		return nil, errors.New("empty store files")
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return nil, err
+		}
+	}
+	return &Client{files: files, interval: time.Second}, nil
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	all, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for k, v := range all {
+		for _, key := range keys {
+			key = path.Join("/", key)
+			if k == key || key == "/" || strings.HasPrefix(k, key+"/") {
+				values[k] = v
+				break
+			}
+		}
+	}
+	return values, nil
+}
+
+// Watch store files by polling their modification time, the returned index is the
+// latest modification time in nanoseconds. When waitIndex is 0 return it immediately.
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	for {
+		index, err := c.index()
+		if err != nil {
+			return waitIndex, err
+		}
+		if waitIndex == 0 || index != waitIndex {
+			return index, nil
+		}
+		select {
+		case <-stopChan:
+			return waitIndex, errors.New("file watch stopped")
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+func (c *Client) index() (uint64, error) {
+	var index uint64
+	for _, f := range c.files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return 0, err
+		}
+		if t := uint64(fi.ModTime().UnixNano()); t > index {
+			index = t
+		}
+	}
+	return index, nil
+}
+
+// load all files, keys in later files override the former ones
+func (c *Client) load() (map[string]string, error) {
+	values := make(map[string]string)
+	for _, f := range c.files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := Decode(f, data, values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Decode parse yaml, json or toml data by the extension of name and add its flattened keys to values
+func Decode(name string, data []byte, values map[string]string) error {
+	var content interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		//keep numbers as written, float64 would turn 1000000 into 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&content)
+	case ".toml":
+		var m map[string]interface{}
+		_, err = toml.Decode(string(data), &m)
+		content = m
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &content)
+	default:
+		err = errors.New("unsupported store file type " + name)
+	}
+	if err != nil {
+		return fmt.Errorf("parse store file %s error: %s", name, err.Error())
+	}
+	flatten("/", content, values)
+	return nil
+}
+
+func flatten(key string, node interface{}, values map[string]string) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			flatten(path.Join(key, k), v, values)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range n {
+			flatten(path.Join(key, fmt.Sprint(k)), v, values)
+		}
+	case []map[string]interface{}:
+		for i, v := range n {
+			flatten(path.Join(key, strconv.Itoa(i)), v, values)
+		}
+	case []interface{}:
+		for i, v := range n {
+			flatten(path.Join(key, strconv.Itoa(i)), v, values)
+		}
+	case nil:
+		values[key] = ""
+	case json.Number:
+		values[key] = n.String()
+	default:
+		values[key] = fmt.Sprint(n)
+	}
+}
+
+// Get return value of a single key, store files are read only and have no index
+func (c *Client) Get(key string) (string, uint64, error) {
+	values, err := c.GetValues([]string{key})
+	if err != nil {
+		return "", 0, err
+	}
+	v, ok := values[path.Join("/", key)]
+	if !ok {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return v, 0, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
+
+func (c *Client) Delete(key string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
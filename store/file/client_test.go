@@ -0,0 +1,94 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGetValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod-file-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := writeFile(t, dir, "base.json", `{"app": {"db": {"host": "10.0.0.1", "port": 3306}, "upstreams": ["a", "b"]}, "other": true}`)
+	override := writeFile(t, dir, "override.yaml", `{"app": {"db": {"host": "10.0.0.2"}}}`)
+	c, err := NewClient([]string{base, override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/app/db/host":     "10.0.0.2",
+		"/app/db/port":     "3306",
+		"/app/upstreams/0": "a",
+		"/app/upstreams/1": "b",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topod-file-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := writeFile(t, dir, "app.json", `{"app": {"key": "1"}}`)
+	c, _ := NewClient([]string{f})
+	c.interval = 10 * time.Millisecond
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/app", 0, stopChan)
+	if err != nil || index == 0 {
+		t.Fatalf("WatchPrefix initial index = %d, %v", index, err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(f, mtime, mtime)
+	changed, err := c.WatchPrefix("/app", index, stopChan)
+	if err != nil || changed == index {
+		t.Fatalf("WatchPrefix changed index = %d, %v, expect not %d", changed, err, index)
+	}
+	close(stopChan)
+	if _, err := c.WatchPrefix("/app", changed, stopChan); err == nil {
+		t.Errorf("stopped watch expect error")
+	}
+}
+
+func TestDecodeNumbers(t *testing.T) {
+	expect := map[string]string{
+		"/id":      "123456789",
+		"/big":     "9007199254740993",
+		"/million": "1000000",
+		"/ratio":   "0.25",
+		"/list/0":  "1000000",
+	}
+	for name, data := range map[string]string{
+		"values.json": `{"id": 123456789, "big": 9007199254740993, "million": 1000000, "ratio": 0.25, "list": [1000000]}`,
+		"values.yaml": "id: 123456789\nbig: 9007199254740993\nmillion: 1000000\nratio: 0.25\nlist: [1000000]\n",
+		"values.toml": "id = 123456789\nbig = 9007199254740993\nmillion = 1000000\nratio = 0.25\nlist = [1000000]\n",
+	} {
+		values := make(map[string]string)
+		if err := Decode(name, []byte(data), values); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, expect) {
+			t.Errorf("Decode %s = %v, expect %v", name, values, expect)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package redis
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/logger"
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+const (
+	dialTimeout = 3 * time.Second
+	scanCount   = "1000"
+)
+
+/*
+* Client reads keys with SCAN over prefix patterns, hash fields are returned as sub
+* keys of the hash key. Prefix watches rely on keyspace notifications, the server
+* must have notify-keyspace-events enabled (at least "K$h", "Kg" for del and "Kx" for expired keys).
+ */
+type Client struct {
+	nodes    []string
+	password string
+	db       int
+	mutex    sync.Mutex
+	conn     *conn
+
+	watchOnce  sync.Once
+	subscribed chan struct{}
+	watchLock  sync.Mutex
+	index      uint64
+	//last change index of every watched prefix
+	prefixes map[string]uint64
+	changed  chan struct{}
+}
+
+func NewClient(nodes []string, password string, db int) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("empty redis nodes")
+	}
+	c := &Client{
+		nodes:      nodes,
+		password:   password,
+		db:         db,
+		index:      1,
+		subscribed: make(chan struct{}),
+		prefixes:   make(map[string]uint64),
+		changed:    make(chan struct{}),
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.connect()
+	return c, err
+}
+
+func (c *Client) connect() (*conn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	var lastError error
+	for _, node := range c.nodes {
+		conn, err := dial(node, c.password, c.db, dialTimeout)
+		if err != nil {
+			lastError = err
+			continue
+		}
+		c.conn = conn
+		return conn, nil
+	}
+	return nil, lastError
+}
+
+// do run one command, drop the connection on network errors so the next call re-dials
+func (c *Client) do(args ...string) (interface{}, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make(map[string]string)
+	for _, key := range keys {
+		key = path.Join("/", key)
+		if err := c.fetch(key, values); err != nil {
+			return values, err
+		}
+		match := escapePattern(strings.TrimRight(key, "/")) + "/*"
+		cursor := "0"
+		for {
+			reply, err := c.do("SCAN", cursor, "MATCH", match, "COUNT", scanCount)
+			if err != nil {
+				return values, err
+			}
+			items, _ := reply.([]interface{})
+			if len(items) != 2 {
+				return values, errors.New("redis: bad scan reply")
+			}
+			for _, k := range toStrings(items[1]) {
+				if err := c.fetch(k, values); err != nil {
+					return values, err
+				}
+			}
+			cursor = toString(items[0])
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return values, nil
+}
+
+func (c *Client) fetch(key string, values map[string]string) error {
+	reply, err := c.do("TYPE", key)
+	if err != nil {
+		return err
+	}
+	switch toString(reply) {
+	case "string":
+		reply, err := c.do("GET", key)
+		if err != nil {
+			return err
+		}
+		if v, ok := reply.(string); ok {
+			values[key] = v
+		}
+	case "hash":
+		reply, err := c.do("HGETALL", key)
+		if err != nil {
+			return err
+		}
+		fields := toStrings(reply)
+		for i := 0; i+1 < len(fields); i += 2 {
+			values[path.Join(key, fields[i])] = fields[i+1]
+		}
+	}
+	return nil
+}
+
+/*
+* Watch prefix with keyspace notifications. A single subscription per client records
+* the last change index of every watched prefix, keys outside them are not kept. When
+* waitIndex is 0 return current index once the subscription is confirmed, so changes
+* made after the call are not missed.
+ */
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	c.watchOnce.Do(func() {
+		go c.subscribe()
+	})
+	select {
+	case <-c.subscribed:
+	case <-stopChan:
+		return waitIndex, errors.New("redis watch stopped")
+	case <-time.After(dialTimeout):
+		return waitIndex, errors.New("redis keyspace subscription not ready")
+	}
+	prefix = path.Join("/", prefix)
+	for {
+		c.watchLock.Lock()
+		index, watched := c.prefixes[prefix]
+		if !watched {
+			//changes before the first watch of prefix are not known
+			c.prefixes[prefix] = c.index
+		}
+		if waitIndex == 0 || !watched {
+			index = c.index
+			c.watchLock.Unlock()
+			return index, nil
+		}
+		changed := c.changed
+		c.watchLock.Unlock()
+		if index > waitIndex {
+			return index, nil
+		}
+		select {
+		case <-stopChan:
+			return waitIndex, errors.New("redis watch stopped")
+		case <-changed:
+		}
+	}
+}
+
+func (c *Client) subscribe() {
+	channel := "__keyspace@" + strconv.Itoa(c.db) + "__:"
+	first := true
+	for {
+		conn, err := c.dialSubscriber(channel + "*")
+		if err != nil {
+			logger.Log.Error("Redis keyspace subscribe error: %s", err.Error())
+			time.Sleep(dialTimeout)
+			continue
+		}
+		if first {
+			close(c.subscribed)
+		} else {
+			//changes may have been missed while the subscription was lost
+			c.notify("", true)
+		}
+		first = false
+		for {
+			reply, err := conn.receive()
+			if err != nil {
+				logger.Log.Warning("Redis keyspace subscription lost: %s", err.Error())
+				conn.close()
+				break
+			}
+			msg := toStrings(reply)
+			if len(msg) == 4 && msg[0] == "pmessage" {
+				c.notify(strings.TrimPrefix(msg[2], channel), false)
+			}
+		}
+	}
+}
+
+func (c *Client) dialSubscriber(pattern string) (*conn, error) {
+	var lastError error
+	for _, node := range c.nodes {
+		conn, err := dial(node, c.password, c.db, dialTimeout)
+		if err != nil {
+			lastError = err
+			continue
+		}
+		if _, err := conn.do("PSUBSCRIBE", pattern); err != nil {
+			conn.close()
+			lastError = err
+			continue
+		}
+		return conn, nil
+	}
+	return nil, lastError
+}
+
+func (c *Client) notify(key string, reset bool) {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	c.index++
+	for prefix := range c.prefixes {
+		if reset || key == prefix || prefix == "/" || strings.HasPrefix(key, prefix+"/") {
+			c.prefixes[prefix] = c.index
+		}
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// escapePattern escape glob special chars so the key is matched literally by SCAN
+func escapePattern(key string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(key)
+}
+
+// Get return value of a string key, redis has no modified index so it is always 0
+func (c *Client) Get(key string) (string, uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return "", 0, err
+	}
+	v, ok := reply.(string)
+	if !ok {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return v, 0, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.do("SET", key, value)
+	return 0, err
+}
+
+// SetTTL set key with an expire, rounded up to whole seconds
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds == 0 {
+		seconds = 1
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.do("SET", key, value, "EX", strconv.FormatInt(seconds, 10))
+	return 0, err
+}
+
+func (c *Client) Delete(key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	reply, err := c.do("DEL", key)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return storeerr.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prefix = path.Join("/", prefix)
+	if _, err := c.do("DEL", prefix); err != nil {
+		return err
+	}
+	match := escapePattern(strings.TrimRight(prefix, "/")) + "/*"
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", match, "COUNT", scanCount)
+		if err != nil {
+			return err
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 2 {
+			return errors.New("redis: bad scan reply")
+		}
+		if keys := toStrings(items[1]); len(keys) > 0 {
+			if _, err := c.do(append([]string{"DEL"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		cursor = toString(items[0])
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// CompareAndSwap only supports creating a missing key, redis keys have no modified index to guard
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	if prevIndex != 0 {
+		return 0, storeerr.ErrNotSupported
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	reply, err := c.do("SET", key, value, "NX")
+	if err != nil {
+		return 0, err
+	}
+	if reply == nil {
+		return 0, storeerr.ErrCompareFailed
+	}
+	return 0, nil
+}
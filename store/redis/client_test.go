@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking the commands used by the client
+type fakeRedis struct {
+	sync.Mutex
+	listener    net.Listener
+	strings     map[string]string
+	hashes      map[string]map[string]string
+	subscribers []*conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: l, strings: make(map[string]string), hashes: make(map[string]map[string]string)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(&conn{c, bufio.NewReader(c), time.Second})
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) set(key, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.strings[key] = value
+	for _, s := range f.subscribers {
+		s.netConn.Write([]byte(encodeArray("pmessage", "__keyspace@0__:*", "__keyspace@0__:"+key, "set")))
+	}
+}
+
+func (f *fakeRedis) serve(c *conn) {
+	defer c.close()
+	for {
+		reply, err := c.receive()
+		if err != nil {
+			return
+		}
+		args := toStrings(reply)
+		f.Lock()
+		var out string
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] == "secret" {
+				out = "+OK\r\n"
+			} else {
+				out = "-ERR invalid password\r\n"
+			}
+		case "TYPE":
+			if _, ok := f.strings[args[1]]; ok {
+				out = "+string\r\n"
+			} else if _, ok := f.hashes[args[1]]; ok {
+				out = "+hash\r\n"
+			} else {
+				out = "+none\r\n"
+			}
+		case "GET":
+			out = encodeBulk(f.strings[args[1]])
+		case "HGETALL":
+			var fields []string
+			for k, v := range f.hashes[args[1]] {
+				fields = append(fields, k, v)
+			}
+			out = encodeArray(fields...)
+		case "SCAN":
+			prefix := strings.TrimSuffix(strings.Replace(args[3], `\`, "", -1), "*")
+			var keys []string
+			for k := range f.strings {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			for k := range f.hashes {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, k)
+				}
+			}
+			out = "*2\r\n" + encodeBulk("0") + encodeArray(keys...)
+		case "PSUBSCRIBE":
+			f.subscribers = append(f.subscribers, c)
+			out = "*3\r\n" + encodeBulk("psubscribe") + encodeBulk(args[1]) + ":1\r\n"
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+		f.Unlock()
+		c.netConn.Write([]byte(out))
+	}
+}
+
+func encodeBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func encodeArray(items ...string) string {
+	out := "*" + strconv.Itoa(len(items)) + "\r\n"
+	for _, item := range items {
+		out += encodeBulk(item)
+	}
+	return out
+}
+
+func TestGetValues(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	f.strings["/app/db/host"] = "10.0.0.1"
+	f.strings["/app/dbx"] = "other"
+	f.hashes["/app/db/options"] = map[string]string{"timeout": "3"}
+	c, err := NewClient([]string{f.listener.Addr().String()}, "secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/app/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/app/db/host":            "10.0.0.1",
+		"/app/db/options/timeout": "3",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	if _, err := NewClient([]string{f.listener.Addr().String()}, "wrong", 0); err == nil {
+		t.Errorf("NewClient with bad password expect error")
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+	c, err := NewClient([]string{f.listener.Addr().String()}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/app", 0, stopChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the subscription is confirmed when the current index is returned, no change is missed
+	f.set("/other/key", "1")
+	f.set("/app/key", "1")
+	result := make(chan uint64)
+	go func() {
+		i, _ := c.WatchPrefix("/app", index, stopChan)
+		result <- i
+	}()
+	select {
+	case i := <-result:
+		if i <= index {
+			t.Errorf("WatchPrefix index = %d, expect greater than %d", i, index)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix not notified")
+	}
+	for i := 0; i < 100; i++ {
+		f.set("/other/key"+strconv.Itoa(i), "1")
+	}
+	c.watchLock.Lock()
+	n := len(c.prefixes)
+	c.watchLock.Unlock()
+	if n != 1 {
+		t.Errorf("client keeps %d change indexes, expect 1 for /app", n)
+	}
+	close(stopChan)
+	if _, err := c.WatchPrefix("/app", index+1000, stopChan); err == nil {
+		t.Errorf("stopped watch expect error")
+	}
+}
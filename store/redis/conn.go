@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// conn is a minimal RESP protocol connection, enough for the commands the store needs
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func dial(addr, password string, db int, timeout time.Duration) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn, bufio.NewReader(netConn), timeout}
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
+
+// do send a command and read its reply within the connection timeout
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.netConn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.netConn.SetDeadline(time.Time{})
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+func (c *conn) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.netConn, b.String())
+	return err
+}
+
+// receive read one reply, bulk strings are returned as string, arrays as []interface{}
+func (c *conn) receive() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", line)
+}
+
+func toString(reply interface{}) string {
+	s, _ := reply.(string)
+	return s
+}
+
+func toStrings(reply interface{}) []string {
+	items, _ := reply.([]interface{})
+	result := make([]string, len(items))
+	for i, item := range items {
+		result[i] = toString(item)
+	}
+	return result
+}
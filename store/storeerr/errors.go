@@ -0,0 +1,11 @@
+// Package storeerr holds errors shared by all store backends, so callers can tell
+// them apart without knowing which backend is configured.
+package storeerr
+
+import "errors"
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrCompareFailed = errors.New("compare failed, key index changed")
+	ErrNotSupported  = errors.New("operation not supported by store")
+)
@@ -0,0 +1,502 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	pollInterval   = 15 * time.Second
+)
+
+var errNotFound = errors.New("vault: secret not found")
+
+/*
+* Client reads secrets from vault kv engines, the first key path segment is the
+* mount: /secret/app/db with fields user and password is returned as
+* /secret/app/db/user and /secret/app/db/password.
+* Kv version 1 and 2 are supported, when kvVersion is 0 it is detected per mount.
+ */
+type Client struct {
+	client    *http.Client
+	nodes     []string
+	authType  string
+	roleID    string
+	secretID  string
+	kvVersion int
+	interval  time.Duration
+
+	mutex    sync.Mutex
+	token    string
+	versions map[string]int
+}
+
+type secretResponse struct {
+	Data json.RawMessage `json:"data"`
+	Auth *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+/*
+*	New vault client, authType is one of token, approle and cert
+*	Use https when schema is https or client cert is given
+ */
+func NewClient(nodes []string, schema, cert, key, caCert, authType, token, roleID, secretID string, kvVersion int) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("empty vault nodes")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if schema == "" {
+		schema = "http"
+	}
+	if (cert != "" && key != "") || caCert != "" {
+		schema = "https"
+		tlsConfig := &tls.Config{}
+		if cert != "" && key != "" {
+			certificate, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		if caCert != "" {
+			ca, err := ioutil.ReadFile(caCert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.New("invalid vault ca cert " + caCert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	machines := make([]string, len(nodes))
+	for i, node := range nodes {
+		if strings.Contains(node, "://") {
+			machines[i] = strings.TrimRight(node, "/")
+		} else {
+			machines[i] = schema + "://" + node
+		}
+	}
+	if authType == "" {
+		authType = "token"
+	}
+	c := &Client{
+		client:    &http.Client{Transport: transport, Timeout: requestTimeout},
+		nodes:     machines,
+		authType:  authType,
+		roleID:    roleID,
+		secretID:  secretID,
+		kvVersion: kvVersion,
+		interval:  pollInterval,
+		token:     token,
+		versions:  make(map[string]int),
+	}
+	if authType != "token" {
+		if err := c.login(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) login() error {
+	var path string
+	var body interface{}
+	switch c.authType {
+	case "approle":
+		path = "/v1/auth/approle/login"
+		body = map[string]string{"role_id": c.roleID, "secret_id": c.secretID}
+	case "cert":
+		path = "/v1/auth/cert/login"
+		body = map[string]string{}
+	default:
+		return errors.New("unsupported vault auth type " + c.authType)
+	}
+	var resp secretResponse
+	if err := c.request("POST", path, body, &resp, false); err != nil {
+		return fmt.Errorf("vault %s login error: %s", c.authType, err.Error())
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return errors.New("vault login returned no client token")
+	}
+	c.mutex.Lock()
+	c.token = resp.Auth.ClientToken
+	c.mutex.Unlock()
+	return nil
+}
+
+/*
+* request send a vault api request, on permission denied re-login once for approle and cert auth.
+* Transport errors, 5xx and 429 replies fail over to the next node.
+ */
+func (c *Client) request(method, path string, body, result interface{}, retry bool) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	var lastError error
+	for _, node := range c.nodes {
+		req, err := http.NewRequest(method, node+path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		if c.token != "" {
+			req.Header.Set("X-Vault-Token", c.token)
+		}
+		c.mutex.Unlock()
+		resp, err := c.client.Do(req)
+		if err == nil && (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) {
+			//sealed, standby without forwarding or rate limited node
+			err = statusError(resp)
+		}
+		if err != nil {
+			lastError = err
+			continue
+		}
+		if resp.StatusCode == http.StatusForbidden && retry && c.authType != "token" {
+			resp.Body.Close()
+			if err := c.login(); err != nil {
+				return err
+			}
+			return c.request(method, path, body, result, false)
+		}
+		return readResponse(resp, result)
+	}
+	return lastError
+}
+
+// readResponse decode the reply into result and close its body
+func readResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode >= 300:
+		return statusError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// statusError return the status and message of a failed reply, and close its body
+func statusError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return fmt.Errorf("vault %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// decodeData decode secret data keeping numbers as written, float64 would round large ones
+func decodeData(data json.RawMessage, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// split return mount and the secret path inside the mount
+func split(key string) (string, string) {
+	parts := strings.SplitN(strings.Trim(key, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+/*
+* version return the kv version of mount. Only a detection is cached: vault without the
+* mounts endpoint answers 404 and is kv v1, other errors are returned and tried again later.
+ */
+func (c *Client) version(mount string) (int, error) {
+	if c.kvVersion != 0 {
+		return c.kvVersion, nil
+	}
+	c.mutex.Lock()
+	v, ok := c.versions[mount]
+	c.mutex.Unlock()
+	if ok {
+		return v, nil
+	}
+	var resp struct {
+		Data struct {
+			Options map[string]string `json:"options"`
+		} `json:"data"`
+	}
+	err := c.request("GET", "/v1/sys/internal/ui/mounts/"+mount, nil, &resp, true)
+	switch {
+	case err == errNotFound:
+		v = 1
+	case err != nil:
+		return 0, fmt.Errorf("vault: detect kv version of %s: %s", mount, err)
+	case resp.Data.Options["version"] == "2":
+		v = 2
+	default:
+		v = 1
+	}
+	c.mutex.Lock()
+	c.versions[mount] = v
+	c.mutex.Unlock()
+	return v, nil
+}
+
+func (c *Client) read(key string) (map[string]interface{}, error) {
+	mount, p := split(key)
+	v, err := c.version(mount)
+	if err != nil {
+		return nil, err
+	}
+	var resp secretResponse
+	if v == 2 {
+		if err := c.request("GET", "/v1/"+mount+"/data/"+p, nil, &resp, true); err != nil {
+			return nil, err
+		}
+		var data struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := decodeData(resp.Data, &data); err != nil {
+			return nil, err
+		}
+		if data.Data == nil {
+			//deleted or destroyed version
+			return nil, errNotFound
+		}
+		return data.Data, nil
+	}
+	if err := c.request("GET", "/v1/"+mount+"/"+p, nil, &resp, true); err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	err = decodeData(resp.Data, &data)
+	return data, err
+}
+
+func (c *Client) list(key string) ([]string, error) {
+	mount, p := split(key)
+	v, err := c.version(mount)
+	if err != nil {
+		return nil, err
+	}
+	api := "/v1/" + mount + "/" + p
+	if v == 2 {
+		api = "/v1/" + mount + "/metadata/" + p
+	}
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err := c.request("GET", strings.TrimRight(api, "/")+"?list=true", nil, &resp, true); err != nil {
+		return nil, err
+	}
+	return resp.Data.Keys, nil
+}
+
+// metadataVersion return current version of a kv v2 secret, 0 for kv v1
+func (c *Client) metadataVersion(key string) (int, error) {
+	mount, p := split(key)
+	if v, err := c.version(mount); err != nil || v != 2 {
+		return 0, err
+	}
+	var resp struct {
+		Data struct {
+			CurrentVersion int `json:"current_version"`
+		} `json:"data"`
+	}
+	if err := c.request("GET", "/v1/"+mount+"/metadata/"+p, nil, &resp, true); err != nil {
+		return 0, err
+	}
+	return resp.Data.CurrentVersion, nil
+}
+
+// walk secrets under key, call fn with every secret path found
+func (c *Client) walk(key string, fn func(secret string) error) error {
+	key = path.Join("/", key)
+	if _, p := split(key); p != "" {
+		if err := fn(key); err != nil && err != errNotFound {
+			return err
+		}
+	}
+	children, err := c.list(key)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if strings.HasSuffix(child, "/") {
+			if err := c.walk(path.Join(key, child), fn); err != nil {
+				return err
+			}
+		} else if err := fn(path.Join(key, child)); err != nil && err != errNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// implement Store.Client interface, GetValues method
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, key := range keys {
+		found := false
+		err := c.walk(key, func(secret string) error {
+			data, err := c.read(secret)
+			if err != nil {
+				return err
+			}
+			found = true
+			for field, v := range data {
+				values[path.Join(secret, field)] = toString(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return values, err
+		}
+		//key may point to a field of a secret
+		if _, p := split(key); !found && p != "" {
+			data, err := c.read(path.Dir(path.Join("/", key)))
+			if err != nil && err != errNotFound {
+				return values, err
+			}
+			if v, ok := data[path.Base(key)]; ok {
+				values[path.Join("/", key)] = toString(v)
+			}
+		}
+	}
+	return values, nil
+}
+
+/*
+* Vault has no watch api, poll secrets under prefix every interval and return a
+* fingerprint of secret versions (kv v2) or secret data (kv v1) when it changes.
+* When waitIndex is 0 return current fingerprint immediately.
+ */
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	for {
+		index, err := c.fingerprint(prefix)
+		if err != nil {
+			return waitIndex, err
+		}
+		if waitIndex == 0 || index != waitIndex {
+			return index, nil
+		}
+		select {
+		case <-stopChan:
+			return waitIndex, errors.New("vault watch stopped")
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+func (c *Client) fingerprint(prefix string) (uint64, error) {
+	var entries []string
+	err := c.walk(prefix, func(secret string) error {
+		mount, _ := split(secret)
+		version, err := c.version(mount)
+		if err != nil {
+			return err
+		}
+		if version == 2 {
+			v, err := c.metadataVersion(secret)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, fmt.Sprintf("%s=%d", secret, v))
+			return nil
+		}
+		data, err := c.read(secret)
+		if err != nil {
+			return err
+		}
+		b, _ := json.Marshal(data)
+		entries = append(entries, secret+"="+string(b))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(entries)
+	h := fnv.New64a()
+	for _, e := range entries {
+		io.WriteString(h, e)
+		h.Write([]byte{0})
+	}
+	//0 means no index for the watcher
+	if sum := h.Sum64(); sum != 0 {
+		return sum, nil
+	}
+	return 1, nil
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// Get return value of a single key, secrets are read only and have no index
+func (c *Client) Get(key string) (string, uint64, error) {
+	values, err := c.GetValues([]string{key})
+	if err != nil {
+		return "", 0, err
+	}
+	v, ok := values[path.Join("/", key)]
+	if !ok {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	return v, 0, nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
+
+func (c *Client) Delete(key string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) DeleteTree(prefix string) error {
+	return storeerr.ErrNotSupported
+}
+
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	return 0, storeerr.ErrNotSupported
+}
@@ -0,0 +1,222 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault serves kv v1 mount "kv" and kv v2 mount "secret"
+type fakeVault struct {
+	sync.Mutex
+	token    string
+	v1       map[string]map[string]interface{}
+	v2       map[string]map[string]interface{}
+	versions map[string]int
+	//mounts endpoint replies 503
+	mountsDown bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	reply := func(data interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": f.token}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	p := r.URL.Path
+	list := r.URL.Query().Get("list") == "true"
+	switch {
+	case strings.HasPrefix(p, "/v1/sys/internal/ui/mounts/") && f.mountsDown:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case strings.HasPrefix(p, "/v1/sys/internal/ui/mounts/"):
+		version := "1"
+		if strings.HasSuffix(p, "/secret") {
+			version = "2"
+		}
+		reply(map[string]interface{}{"options": map[string]string{"version": version}})
+	case strings.HasPrefix(p, "/v1/secret/"):
+		kind := strings.SplitN(strings.TrimPrefix(p, "/v1/secret/"), "/", 2)
+		if len(kind) < 2 {
+			kind = append(kind, "")
+		}
+		if list {
+			reply(map[string]interface{}{"keys": listKeys(f.v2, kind[1])})
+		} else if data, ok := f.v2[kind[1]]; ok && kind[0] == "data" {
+			reply(map[string]interface{}{"data": data})
+		} else if ok && kind[0] == "metadata" {
+			reply(map[string]interface{}{"current_version": f.versions[kind[1]]})
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case strings.HasPrefix(p, "/v1/kv/"):
+		key := strings.TrimPrefix(p, "/v1/kv/")
+		if list {
+			reply(map[string]interface{}{"keys": listKeys(f.v1, key)})
+		} else if data, ok := f.v1[key]; ok {
+			reply(data)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func listKeys(secrets map[string]map[string]interface{}, dir string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for k := range secrets {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[:i+1]
+		}
+		if !seen[rest] {
+			seen[rest] = true
+			keys = append(keys, rest)
+		}
+	}
+	return keys
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{
+		token: "s.token",
+		v1: map[string]map[string]interface{}{
+			"app/db": {"user": "root", "port": 3306, "id": json.Number("12345678901234567890")},
+		},
+		v2: map[string]map[string]interface{}{
+			"app/db":        {"password": "pass"},
+			"app/cache/key": {"value": "abc"},
+		},
+		versions: map[string]int{"app/db": 1, "app/cache/key": 3},
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	server := httptest.NewServer(newFakeVault())
+	defer server.Close()
+	c, err := NewClient([]string{server.URL}, "http", "", "", "", "token", "s.token", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/kv/app", "/secret/app", "/secret/app/db/password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"/kv/app/db/user":             "root",
+		"/kv/app/db/port":             "3306",
+		"/kv/app/db/id":               "12345678901234567890",
+		"/secret/app/db/password":     "pass",
+		"/secret/app/cache/key/value": "abc",
+	}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		server := httptest.NewServer(newFakeVault())
+		c, _ := NewClient([]string{down.URL, server.URL}, "http", "", "", "", "token", "s.token", "", "", 0)
+		values, err := c.GetValues([]string{"/secret/app/db"})
+		if err != nil || values["/secret/app/db/password"] != "pass" {
+			t.Errorf("GetValues with a first node replying %d = %v, %v", status, values, err)
+		}
+		c, _ = NewClient([]string{down.URL}, "http", "", "", "", "token", "s.token", "", "", 0)
+		if _, err := c.GetValues([]string{"/secret/app/db"}); err == nil || !strings.Contains(err.Error(), strconv.Itoa(status)) {
+			t.Errorf("GetValues with all nodes replying %d error = %v", status, err)
+		}
+		down.Close()
+		server.Close()
+	}
+}
+
+func TestVersionDetection(t *testing.T) {
+	f := newFakeVault()
+	f.mountsDown = true
+	server := httptest.NewServer(f)
+	defer server.Close()
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "token", "s.token", "", "", 0)
+	if _, err := c.GetValues([]string{"/secret/app/db"}); err == nil {
+		t.Errorf("GetValues with failed kv version detection expect error")
+	}
+	//the failure is not cached as kv v1
+	f.Lock()
+	f.mountsDown = false
+	f.Unlock()
+	values, err := c.GetValues([]string{"/secret/app/db"})
+	if err != nil || values["/secret/app/db/password"] != "pass" {
+		t.Errorf("GetValues after detection recovered = %v, %v", values, err)
+	}
+}
+
+func TestAppRoleLogin(t *testing.T) {
+	server := httptest.NewServer(newFakeVault())
+	defer server.Close()
+	if _, err := NewClient([]string{server.URL}, "http", "", "", "", "approle", "", "role", "wrong", 0); err == nil {
+		t.Errorf("approle login with bad secret id expect error")
+	}
+	c, err := NewClient([]string{server.URL}, "http", "", "", "", "approle", "", "role", "secret", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := c.GetValues([]string{"/secret/app/db"})
+	if err != nil || values["/secret/app/db/password"] != "pass" {
+		t.Errorf("GetValues after approle login = %v, %v", values, err)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	f := newFakeVault()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	c, _ := NewClient([]string{server.URL}, "http", "", "", "", "token", "s.token", "", "", 0)
+	c.interval = 10 * time.Millisecond
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/secret/app", 0, stopChan)
+	if err != nil || index == 0 {
+		t.Fatalf("WatchPrefix initial index = %d, %v", index, err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.Lock()
+		f.versions["app/db"] = 2
+		f.Unlock()
+	}()
+	changed, err := c.WatchPrefix("/secret/app", index, stopChan)
+	if err != nil || changed == index {
+		t.Fatalf("WatchPrefix changed index = %d, %v, expect not %d", changed, err, index)
+	}
+	close(stopChan)
+	if _, err := c.WatchPrefix("/secret/app", changed, stopChan); err == nil {
+		t.Errorf("stopped watch expect error")
+	}
+}
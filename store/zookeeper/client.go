@@ -0,0 +1,387 @@
+package zookeeper
+
+import (
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	zk "github.com/samuel/go-zookeeper/zk"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+const sessionTimeout = 5 * time.Second
+
+// missingIndex is the index of a missing prefix, zxids of existing znodes are higher
+const missingIndex = 1
+
+// zkConn is the part of *zk.Conn used by the client
+type zkConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	SessionID() int64
+}
+
+type Client struct {
+	conn    zkConn
+	lock    sync.Mutex
+	watches map[string]*treeWatch
+}
+
+/*
+* treeWatch hold the znode watches armed under a prefix. A data and a child watch are
+* armed once per znode and armed again only after they fired, so repeated WatchPrefix
+* calls do not pile up watches in the zookeeper connection.
+ */
+type treeWatch struct {
+	lock    sync.Mutex
+	armed   map[string]bool
+	err     error
+	changed chan struct{}
+}
+
+func newClient(conn zkConn) *Client {
+	return &Client{conn: conn, watches: make(map[string]*treeWatch)}
+}
+
+/*
+*	New zookeeper connections return *zookeeper.Client
+*	digest is an optional user:password pair for digest auth
+ */
+func NewClient(machines []string, digest string) (*Client, error) {
+	c, _, err := zk.Connect(machines, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if digest != "" {
+		if err := c.AddAuth("digest", []byte(digest)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return newClient(c), nil
+}
+
+// implement Store.Client interface, GetValues method, walk child znodes recursively
+func (c *Client) GetValues(keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, key := range keys {
+		if _, err := c.walk(path.Join("/", key), values, nil); err != nil {
+			return values, err
+		}
+	}
+	return values, nil
+}
+
+/*
+* walk the znode tree under key, store leaf and non-empty node data in values and
+* return the highest mzxid or pzxid found, 0 when key is missing. When tw is not nil data
+* and child watches are armed on visited znodes which do not have one yet, and an exists
+* watch on a missing key so its creation is seen.
+ */
+func (c *Client) walk(key string, values map[string]string, tw *treeWatch) (uint64, error) {
+	var data []byte
+	var children []string
+	var stat *zk.Stat
+	var err error
+	if tw != nil && !tw.isArmed("data:"+key) {
+		var ch <-chan zk.Event
+		if data, stat, ch, err = c.conn.GetW(key); err == nil {
+			tw.arm("data:"+key, ch)
+		}
+	} else {
+		data, stat, err = c.conn.Get(key)
+	}
+	if err == nil {
+		if tw != nil && !tw.isArmed("child:"+key) {
+			var ch <-chan zk.Event
+			if children, _, ch, err = c.conn.ChildrenW(key); err == nil {
+				tw.arm("child:"+key, ch)
+			}
+		} else {
+			children, _, err = c.conn.Children(key)
+		}
+	}
+	if err == zk.ErrNoNode {
+		if tw == nil || tw.isArmed("exists:"+key) {
+			return 0, nil
+		}
+		exists, _, ch, err := c.conn.ExistsW(key)
+		if err != nil {
+			return 0, err
+		}
+		tw.arm("exists:"+key, ch)
+		if exists {
+			//created since the first read
+			return c.walk(key, values, tw)
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	index := uint64(stat.Mzxid)
+	if uint64(stat.Pzxid) > index {
+		index = uint64(stat.Pzxid)
+	}
+	if len(children) == 0 || len(data) > 0 {
+		values[key] = string(data)
+	}
+	for _, child := range children {
+		i, err := c.walk(path.Join(key, child), values, tw)
+		if err != nil {
+			return 0, err
+		}
+		if i > index {
+			index = i
+		}
+	}
+	return index, nil
+}
+
+/*
+* Watch prefix with data and child watches on every znode of the subtree, return the
+* highest mzxid under prefix after a change, or missingIndex when prefix does not exist.
+* When waitIndex is 0 return it immediately. Watches of a prefix are kept between calls,
+* only the ones which fired are armed again.
+ */
+func (c *Client) WatchPrefix(prefix string, waitIndex uint64, stopChan chan bool) (uint64, error) {
+	prefix = path.Join("/", prefix)
+	if waitIndex == 0 {
+		return c.prefixIndex(prefix, nil)
+	}
+	tw := c.treeWatch(prefix)
+	for {
+		changed := tw.wait()
+		index, err := c.prefixIndex(prefix, tw)
+		if err != nil {
+			return waitIndex, err
+		}
+		//changed before watches were set, the index only goes down when prefix is deleted
+		if index != waitIndex {
+			return index, nil
+		}
+		select {
+		case <-stopChan:
+			return waitIndex, errors.New("zookeeper watch stopped")
+		case <-changed:
+			if err := tw.takeErr(); err != nil {
+				return waitIndex, err
+			}
+		}
+	}
+}
+
+func (c *Client) prefixIndex(prefix string, tw *treeWatch) (uint64, error) {
+	index, err := c.walk(prefix, make(map[string]string), tw)
+	if err == nil && index == 0 {
+		index = missingIndex
+	}
+	return index, err
+}
+
+func (c *Client) treeWatch(prefix string) *treeWatch {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tw, ok := c.watches[prefix]
+	if !ok {
+		tw = &treeWatch{armed: make(map[string]bool), changed: make(chan struct{})}
+		c.watches[prefix] = tw
+	}
+	return tw
+}
+
+func (tw *treeWatch) isArmed(key string) bool {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	return tw.armed[key]
+}
+
+// arm record the watch of key until its event, which wakes up the waiters of the prefix
+func (tw *treeWatch) arm(key string, ch <-chan zk.Event) {
+	tw.lock.Lock()
+	tw.armed[key] = true
+	tw.lock.Unlock()
+	go func() {
+		e := <-ch
+		tw.lock.Lock()
+		defer tw.lock.Unlock()
+		delete(tw.armed, key)
+		if e.Err != nil {
+			tw.err = e.Err
+		}
+		close(tw.changed)
+		tw.changed = make(chan struct{})
+	}()
+}
+
+// wait return a channel closed on the next fired watch
+func (tw *treeWatch) wait() chan struct{} {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	return tw.changed
+}
+
+func (tw *treeWatch) takeErr() error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	err := tw.err
+	tw.err = nil
+	return err
+}
+
+// Get return data and mzxid of a single znode
+func (c *Client) Get(key string) (string, uint64, error) {
+	data, stat, err := c.conn.Get(path.Join("/", key))
+	if err == zk.ErrNoNode {
+		return "", 0, storeerr.ErrKeyNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return string(data), uint64(stat.Mzxid), nil
+}
+
+func (c *Client) Set(key, value string) (uint64, error) {
+	key = path.Join("/", key)
+	stat, err := c.conn.Set(key, []byte(value), -1)
+	if err == zk.ErrNoNode {
+		if err := c.create(key, value); err != nil {
+			return 0, err
+		}
+		_, index, err := c.Get(key)
+		return index, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Mzxid), nil
+}
+
+/*
+* SetTTL write key as an ephemeral znode of the topod session, zookeeper removes it when
+* the session ends. The session timeout, not ttl, bounds how long the key outlives a dead
+* topod. A persistent znode or one of another session is replaced.
+ */
+func (c *Client) SetTTL(key, value string, ttl time.Duration) (uint64, error) {
+	key = path.Join("/", key)
+	_, stat, err := c.conn.Get(key)
+	if err == nil && stat.EphemeralOwner != c.conn.SessionID() {
+		if err := c.conn.Delete(key, -1); err != nil && err != zk.ErrNoNode {
+			return 0, err
+		}
+		err = zk.ErrNoNode
+	}
+	if err == zk.ErrNoNode {
+		if err := c.createNode(key, value, zk.FlagEphemeral); err != nil {
+			return 0, err
+		}
+		_, index, err := c.Get(key)
+		return index, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	stat, err = c.conn.Set(key, []byte(value), -1)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Mzxid), nil
+}
+
+func (c *Client) Delete(key string) error {
+	err := c.conn.Delete(path.Join("/", key), -1)
+	if err == zk.ErrNoNode {
+		return storeerr.ErrKeyNotFound
+	}
+	return err
+}
+
+// DeleteTree delete child znodes first, zookeeper refuses to delete a znode with children
+func (c *Client) DeleteTree(prefix string) error {
+	prefix = path.Join("/", prefix)
+	children, _, err := c.conn.Children(prefix)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := c.DeleteTree(path.Join(prefix, child)); err != nil {
+			return err
+		}
+	}
+	if prefix == "/" {
+		return nil
+	}
+	if err := c.conn.Delete(prefix, -1); err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	return nil
+}
+
+/*
+* CompareAndSwap set the znode only when its mzxid is prevIndex, the write is guarded
+* by the znode version read along with mzxid. prevIndex 0 create the znode.
+ */
+func (c *Client) CompareAndSwap(key, value string, prevIndex uint64) (uint64, error) {
+	key = path.Join("/", key)
+	if prevIndex == 0 {
+		err := c.create(key, value)
+		if err == zk.ErrNodeExists {
+			return 0, storeerr.ErrCompareFailed
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, index, err := c.Get(key)
+		return index, err
+	}
+	_, stat, err := c.conn.Get(key)
+	if err == zk.ErrNoNode {
+		return 0, storeerr.ErrCompareFailed
+	}
+	if err != nil {
+		return 0, err
+	}
+	if uint64(stat.Mzxid) != prevIndex {
+		return 0, storeerr.ErrCompareFailed
+	}
+	stat, err = c.conn.Set(key, []byte(value), stat.Version)
+	if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+		return 0, storeerr.ErrCompareFailed
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Mzxid), nil
+}
+
+// create the znode and its missing parents
+func (c *Client) create(key, value string) error {
+	return c.createNode(key, value, 0)
+}
+
+// createNode create key with flags and its missing parents as persistent znodes
+func (c *Client) createNode(key, value string, flags int32) error {
+	if parent := path.Dir(key); parent != "/" {
+		if _, err := c.conn.Create(parent, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			if err != zk.ErrNoNode {
+				return err
+			}
+			if err := c.create(parent, ""); err != nil && err != zk.ErrNodeExists {
+				return err
+			}
+		}
+	}
+	_, err := c.conn.Create(key, []byte(value), flags, zk.WorldACL(zk.PermAll))
+	return err
+}
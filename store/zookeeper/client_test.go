@@ -0,0 +1,324 @@
+package zookeeper
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	zk "github.com/samuel/go-zookeeper/zk"
+
+	"github.com/leightonwong/topod/store/storeerr"
+)
+
+type fakeNode struct {
+	data  string
+	mzxid int64
+}
+
+type fakeConn struct {
+	sync.Mutex
+	nodes   map[string]fakeNode
+	zxid    int64
+	watches map[string][]chan zk.Event
+	//session owning each ephemeral node
+	owners map[string]int64
+}
+
+const fakeSession = 7
+
+func (f *fakeConn) SessionID() int64 {
+	return fakeSession
+}
+
+func (f *fakeConn) children(p string) []string {
+	var children []string
+	for k := range f.nodes {
+		if strings.HasPrefix(k, p+"/") && !strings.Contains(k[len(p)+1:], "/") {
+			children = append(children, k[len(p)+1:])
+		}
+	}
+	return children
+}
+
+func (f *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	f.Lock()
+	defer f.Unlock()
+	n, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(n.data), &zk.Stat{Mzxid: n.mzxid, Version: int32(n.mzxid), EphemeralOwner: f.owners[p]}, nil
+}
+
+func (f *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return f.children(p), &zk.Stat{}, nil
+}
+
+// watch register a watch like go-zookeeper, it stays registered until it fires
+func (f *fakeConn) watch(key string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	f.watches[key] = append(f.watches[key], ch)
+	return ch
+}
+
+func (f *fakeConn) watchCount() int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, chs := range f.watches {
+		n += len(chs)
+	}
+	return n
+}
+
+func (f *fakeConn) watched(key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.watches[key]) > 0
+}
+
+func (f *fakeConn) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	data, stat, err := f.Get(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	return data, stat, f.watch("data:" + p), err
+}
+
+func (f *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := f.Children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	return children, stat, f.watch("child:" + p), err
+}
+
+func (f *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.nodes[p]
+	return ok, &zk.Stat{}, f.watch("exists:" + p), nil
+}
+
+func (f *fakeConn) set(p, data string, mzxid int64) {
+	f.Lock()
+	defer f.Unlock()
+	f.nodes[p] = fakeNode{data, mzxid}
+	for _, ch := range f.watches["data:"+p] {
+		ch <- zk.Event{Type: zk.EventNodeDataChanged, Path: p}
+	}
+	delete(f.watches, "data:"+p)
+}
+
+func (f *fakeConn) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	f.Lock()
+	defer f.Unlock()
+	n, ok := f.nodes[p]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+	//fake version is the mzxid
+	if version != -1 && int64(version) != n.mzxid {
+		return nil, zk.ErrBadVersion
+	}
+	f.zxid++
+	f.nodes[p] = fakeNode{string(data), f.zxid}
+	return &zk.Stat{Mzxid: f.zxid}, nil
+}
+
+func (f *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	if _, ok := f.nodes[path.Dir(p)]; !ok && path.Dir(p) != "/" {
+		return "", zk.ErrNoNode
+	}
+	f.zxid++
+	f.nodes[p] = fakeNode{string(data), f.zxid}
+	if flags&zk.FlagEphemeral != 0 {
+		f.owners[p] = fakeSession
+	}
+	for _, ch := range f.watches["exists:"+p] {
+		ch <- zk.Event{Type: zk.EventNodeCreated, Path: p}
+	}
+	delete(f.watches, "exists:"+p)
+	return p, nil
+}
+
+func (f *fakeConn) Delete(p string, version int32) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(f.nodes, p)
+	delete(f.owners, p)
+	return nil
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{zxid: 5, watches: make(map[string][]chan zk.Event), owners: make(map[string]int64), nodes: map[string]fakeNode{
+		"/app":         {"", 1},
+		"/app/db":      {"", 2},
+		"/app/db/host": {"10.0.0.1", 3},
+		"/app/db/port": {"3306", 4},
+		"/app/name":    {"app", 5},
+	}}
+}
+
+func TestGetValues(t *testing.T) {
+	c := newClient(newFakeConn())
+	values, err := c.GetValues([]string{"/app/db", "/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"/app/db/host": "10.0.0.1", "/app/db/port": "3306"}
+	if !reflect.DeepEqual(values, expect) {
+		t.Errorf("GetValues = %v, expect %v", values, expect)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	conn := newFakeConn()
+	c := newClient(conn)
+	stopChan := make(chan bool)
+	index, err := c.WatchPrefix("/app", 0, stopChan)
+	if err != nil || index != 5 {
+		t.Fatalf("WatchPrefix initial index = %d, %v, expect 5", index, err)
+	}
+	result := make(chan uint64)
+	go func() {
+		i, _ := c.WatchPrefix("/app", index, stopChan)
+		result <- i
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn.set("/app/db/host", "10.0.0.2", 6)
+	select {
+	case i := <-result:
+		if i != 6 {
+			t.Errorf("WatchPrefix changed index = %d, expect 6", i)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix not notified")
+	}
+	//only the fired watch is armed again, the others stay registered once
+	armed := conn.watchCount()
+	index = 6
+	for i := int64(7); i < 17; i++ {
+		go conn.set("/app/name", "app", i)
+		if index, err = c.WatchPrefix("/app", index, stopChan); err != nil || index != uint64(i) {
+			t.Fatalf("WatchPrefix index = %d, %v, expect %d", index, err, i)
+		}
+	}
+	if n := conn.watchCount(); n > armed+1 {
+		t.Errorf("zookeeper watches = %d after 10 changes, expect at most %d", n, armed+1)
+	}
+	close(stopChan)
+	if _, err := c.WatchPrefix("/app", index, stopChan); err == nil {
+		t.Errorf("stopped watch expect error")
+	}
+}
+
+func TestWatchMissingPrefix(t *testing.T) {
+	conn := newFakeConn()
+	c := newClient(conn)
+	stopChan := make(chan bool)
+	defer close(stopChan)
+	index, err := c.WatchPrefix("/web", 0, stopChan)
+	if err != nil || index != missingIndex {
+		t.Fatalf("WatchPrefix missing prefix initial index = %d, %v, expect %d", index, err, missingIndex)
+	}
+	result := make(chan uint64)
+	go func() {
+		i, _ := c.WatchPrefix("/web", index, stopChan)
+		result <- i
+	}()
+	//create the prefix once the exists watch is armed
+	for deadline := time.Now().Add(5 * time.Second); !conn.watched("exists:/web"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("WatchPrefix armed no exists watch on the missing prefix")
+		}
+	}
+	if _, err := conn.Create("/web", []byte("up"), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case i := <-result:
+		if i != 6 {
+			t.Errorf("WatchPrefix created prefix index = %d, expect 6", i)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchPrefix not notified of the prefix creation")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c := newClient(newFakeConn())
+	if _, err := c.CompareAndSwap("/app/db/host", "10.0.0.2", 0); err != storeerr.ErrCompareFailed {
+		t.Errorf("create existing znode error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	index, err := c.CompareAndSwap("/app/new/key", "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CompareAndSwap("/app/new/key", "2", index+1); err != storeerr.ErrCompareFailed {
+		t.Errorf("swap with stale index error = %v, expect %v", err, storeerr.ErrCompareFailed)
+	}
+	if _, err := c.CompareAndSwap("/app/new/key", "2", index); err != nil {
+		t.Errorf("swap with current index error = %v", err)
+	}
+	if v, _, _ := c.Get("/app/new/key"); v != "2" {
+		t.Errorf("Get after swap = %s, expect 2", v)
+	}
+	if err := c.DeleteTree("/app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Get("/app/db/host"); err != storeerr.ErrKeyNotFound {
+		t.Errorf("Get after DeleteTree error = %v, expect %v", err, storeerr.ErrKeyNotFound)
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	conn := newFakeConn()
+	c := newClient(conn)
+	//a persistent node is replaced by an ephemeral one
+	index, err := c.SetTTL("/app/name", "web", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.owners["/app/name"] != fakeSession {
+		t.Errorf("/app/name is not an ephemeral node of the session")
+	}
+	if v, i, _ := c.Get("/app/name"); v != "web" || i != index {
+		t.Errorf("Get(/app/name) = %q, %d, expect web, %d", v, i, index)
+	}
+	//an ephemeral node of the session is updated in place
+	next, err := c.SetTTL("/app/name", "api", 30*time.Second)
+	if err != nil || next <= index {
+		t.Fatalf("SetTTL = %d, %v, expect an index above %d", next, err, index)
+	}
+	if v, _, _ := c.Get("/app/name"); v != "api" || conn.owners["/app/name"] != fakeSession {
+		t.Errorf("Get(/app/name) = %q after update", v)
+	}
+	//missing parents are created persistent
+	if _, err := c.SetTTL("/services/web/10.0.0.3:80", "{}", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if conn.owners["/services/web"] != 0 || conn.owners["/services/web/10.0.0.3:80"] != fakeSession {
+		t.Errorf("owners = %v, expect only the leaf to be ephemeral", conn.owners)
+	}
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/leightonwong/topod/api"
 	"github.com/leightonwong/topod/conf/template"
+	"github.com/leightonwong/topod/discovery"
 	"github.com/leightonwong/topod/logger"
 	storage "github.com/leightonwong/topod/store"
 )
 
 func main() {
+	isCommand := false
+	switch options.Verbs {
+	case "get", "set", "rm", "ls", "export", "import", "register", "config":
+		isCommand = true
+		logger.SetOutput(os.Stderr)
+	}
 	logger.SetLevel(options.Debug, options.Verbose)
 	if options.Version {
 		fmt.Printf("Topod version %s\n", Version)
@@ -20,8 +32,28 @@ func main() {
 	if err := initConfig(); err != nil {
 		logger.Log.Fatal(err.Error())
 	}
+	if options.Verbs == "config" {
+		if err := printConfig(config, os.Stdout); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		os.Exit(0)
+	}
+	if isCommand {
+		storeClient, err := storage.NewClient(storeConfig)
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		if err := runCommand(storeClient); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	logger.Log.Notice("Starting topod")
-	storeClient, _ := storage.NewClient(storeConfig)
+	storeClient, err := storage.NewClient(storeConfig)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
 	templateConfig.StoreClient = storeClient
 	if options.Verbs == "gen" {
 		if err := template.ProcessOnce(&templateConfig); err != nil {
@@ -30,32 +62,133 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if options.Verbs == "watch" && config.Watch.Once {
+		os.Exit(watchOnce())
+	}
+	os.Exit(serve(storeClient))
+}
 
+// shutdownTimeout bound the wait for api requests in progress on shutdown
+const shutdownTimeout = 10 * time.Second
+
+/*
+* serve run the watch or pull processor with discovery scanners, service registrars and
+* the management api until SIGINT or SIGTERM. The signal cancels the processor context
+* and closes stopChan: watches stop, renders in progress and their reload_cmd finish or
+* time out, services are deregistered, then serve returns 0. It returns 1 when the
+* processor fails, a second signal exits at once with 2.
+ */
+func serve(storeClient storage.StoreClient) int {
+	ctx, cancel := context.WithCancel(context.Background())
 	stopChan := make(chan bool)
-	doneChan := make(chan bool)
 	errChan := make(chan error, 10)
 	var processor template.Processor
 	switch options.Verbs {
-	case "watch":
-		processor = template.NewWatcher(&templateConfig, stopChan, doneChan, errChan)
 	case "pull":
-		fmt.Println("Pull interval not implement")
-		os.Exit(0)
+		processor = template.NewIntervaler(&templateConfig, config.Pull.Interval, config.Pull.Jitter, errChan)
 	default:
-		processor = template.NewWatcher(&templateConfig, stopChan, doneChan, errChan)
+		processor = template.NewWatcher(&templateConfig, errChan)
 	}
-	go processor.Process()
+	for _, c := range config.Discovery {
+		scanner, err := discovery.NewScanner(c, config.Prefix, storeClient)
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		go scanner.Run(stopChan, errChan)
+	}
+	registered, err := startRegistrars(storeClient, config.Register, stopChan, errChan)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	var server *api.Server
+	if config.API.Listen != "" {
+		auth := api.Auth{Token: config.API.Token, Cert: config.API.Cert, Key: config.API.Key, ClientCA: config.API.ClientCA}
+		server, err = api.NewServer(config.API.Listen, config.Prefix, auth, storeClient, processor)
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+	}
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			cancel()
+			close(stopChan)
+			if server != nil {
+				timeout, done := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer done()
+				server.Shutdown(timeout)
+			}
+		})
+	}
+	finished := make(chan error, 1)
+	go func() {
+		err := processor.Process(ctx)
+		shutdown()
+		registered.Wait()
+		finished <- err
+	}()
+
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopping := false
 	for {
 		select {
 		case err := <-errChan:
 			logger.Log.Error(err.Error())
 		case s := <-signalChan:
-			logger.Log.Info("captured %v exiting...", s)
-			close(doneChan)
-		case <-doneChan:
-			os.Exit(0)
+			if s == syscall.SIGHUP {
+				if reloader, ok := processor.(template.Reloader); ok {
+					logger.Log.Info("captured %v reloading...", s)
+					reloader.Reload()
+				}
+				continue
+			}
+			if stopping {
+				logger.Log.Warning("captured %v again, exiting without waiting", s)
+				return 2
+			}
+			stopping = true
+			logger.Log.Info("captured %v shutting down...", s)
+			go shutdown()
+		case err := <-finished:
+			if err != nil {
+				logger.Log.Error(err.Error())
+				return 1
+			}
+			logger.Log.Notice("Topod stopped")
+			return 0
 		}
 	}
 }
+
+/*
+* watchOnce render, wait for the first change and re-render the affected resources.
+* Exit code is 0 when every resource is rendered, 1 on a render error and 2 when
+* interrupted before any change.
+ */
+func watchOnce() int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signalChan
+		logger.Log.Info("captured %v exiting...", s)
+		cancel()
+	}()
+	err := template.WatchOnce(ctx, &templateConfig)
+	if err == template.ErrStopped {
+		logger.Log.Warning(err.Error())
+		return 2
+	}
+	if err != nil {
+		logger.Log.Error("Watch once error: %s", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+
+	storage "github.com/leightonwong/topod/store"
+	"github.com/leightonwong/topod/store/file"
+)
+
+// runExport write the whole key tree under prefix to w as yaml, json or toml
+func runExport(client storage.StoreClient, format string, w io.Writer) error {
+	values, err := client.GetValues([]string{fullKey("/")})
+	if err != nil {
+		return err
+	}
+	tree := newKeyTree(values)
+	switch format {
+	case "", "yaml", "yml":
+		data, err := yaml.Marshal(tree)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "json":
+		return printJson(values, w)
+	case "toml":
+		return toml.NewEncoder(w).Encode(tree)
+	}
+	return errors.New("export: unsupported format " + format)
+}
+
+/*
+* runImport set keys of the yaml, json or toml file under prefix. Pending changes are
+* printed to w first, with dryRun nothing is written. With prune keys under prefix
+* absent from the file are deleted.
+ */
+func runImport(client storage.StoreClient, args []string, dryRun, prune bool, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("import: file required")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	relative := make(map[string]string)
+	if err := file.Decode(args[0], data, relative); err != nil {
+		return err
+	}
+	desired := make(map[string]string)
+	for k, v := range relative {
+		desired[fullKey(k)] = v
+	}
+	current, err := client.GetValues([]string{fullKey("/")})
+	if err != nil {
+		return err
+	}
+	sets, deletes := diffValues(current, desired, prune, w)
+	if dryRun {
+		fmt.Fprintf(w, "dry run, %d keys to set, %d keys to delete\n", len(sets), len(deletes))
+		return nil
+	}
+	for _, k := range sets {
+		if _, err := client.Set(k, desired[k]); err != nil {
+			return fmt.Errorf("import set %s: %s", k, err.Error())
+		}
+	}
+	for _, k := range deletes {
+		if err := client.Delete(k); err != nil && err != storage.ErrKeyNotFound {
+			return fmt.Errorf("import delete %s: %s", k, err.Error())
+		}
+	}
+	fmt.Fprintf(w, "%d keys set, %d keys deleted\n", len(sets), len(deletes))
+	return nil
+}
+
+// diffValues print the changes from current to desired and return keys to set and to delete
+func diffValues(current, desired map[string]string, prune bool, w io.Writer) ([]string, []string) {
+	var sets, deletes []string
+	for k, v := range desired {
+		if old, ok := current[k]; !ok || old != v {
+			sets = append(sets, k)
+		}
+	}
+	if prune {
+		for k := range current {
+			if _, ok := desired[k]; !ok {
+				deletes = append(deletes, k)
+			}
+		}
+	}
+	sort.Strings(sets)
+	sort.Strings(deletes)
+	for _, k := range sets {
+		if old, ok := current[k]; ok {
+			fmt.Fprintf(w, "~ %s: %q -> %q\n", k, old, desired[k])
+		} else {
+			fmt.Fprintf(w, "+ %s = %q\n", k, desired[k])
+		}
+	}
+	for _, k := range deletes {
+		fmt.Fprintf(w, "- %s\n", k)
+	}
+	return sets, deletes
+}